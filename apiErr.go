@@ -11,6 +11,8 @@ var (
 	UnauthorizedErr            *ApiError
 	ForbiddenErr               *ApiError
 	InternalErr                *ApiError
+	TimeoutErr                 *ApiError
+	TooManyRequestsErr         *ApiError
 	InvalidUsernameErr         *ApiError
 	InvalidNicknameErr         *ApiError
 	InvalidPasswordErr         *ApiError
@@ -18,6 +20,13 @@ var (
 	MobileUserBadCodeErr       *ApiError
 	MobileUserBadTokenErr      *ApiError
 	MobileUserAlreadyExistsErr *ApiError
+	SmsCooldownErr             *ApiError
+	SmsQuotaExceededErr        *ApiError
+	SmsCodeExpiredErr          *ApiError
+	AccountLockedErr           *ApiError
+	IdentityTakenErr           *ApiError
+	ProviderLinkedErr          *ApiError
+	LastLoginMethodErr         *ApiError
 )
 
 const (
@@ -27,8 +36,12 @@ const (
 	ECodeUnauthorized                    = 40100
 	ECodeForbidden                       = 40300
 	ECodeNotFound                        = 40400
+	ECodePayloadTooLarge                 = 41300
+	ECodeUnsupportedMediaType            = 41500
+	ECodeTooManyRequests                 = 42900
 	ECodeInternal                        = 50000
 	ECode3rdPartyAuthFailed              = 50300
+	ECodeTimeout                         = 50400
 	ECodeInvalidUsername                 = 60001
 	ECodeInvalidNickname                 = 60002
 	ECodeInvalidPassword                 = 60003
@@ -36,35 +49,86 @@ const (
 	ECodeMobileUserBadCode               = 60102
 	ECodeMobileUserBadToken              = 60103
 	ECodeMobileUserAlreadyExists         = 60104
+	ECodeSmsCooldown                     = 60105
+	ECodeSmsQuotaExceeded                = 60106
+	ECodeSmsCodeExpired                  = 60107
+	ECodeAccountLocked                   = 60108
+	ECodeIdentityTaken                   = 60109
+	ECodeProviderLinked                  = 60110
+	ECodeLastLoginMethod                 = 60111
 )
 
 type ErrCode int
 
 func init() {
-	NotFoundErr = NewApiErr(ECodeNotFound, "NotFound error")
-	UnauthorizedErr = NewApiErr(ECodeUnauthorized, "Unauthorized error")
-	ForbiddenErr = NewApiErr(ECodeForbidden, "Forbidden error")
-	InternalErr = NewApiErr(ECodeInternal, "Internal error")
-	InvalidUsernameErr = NewApiErr(ECodeInvalidUsername, "Invalid username")
-	InvalidNicknameErr = NewApiErr(ECodeInvalidNickname, "Invalid nickname")
-	InvalidPasswordErr = NewApiErr(ECodeInvalidPassword, "Invalid password")
-	MobileUserNotFoundErr = NewApiErr(ECodeMobileUserNotFound, "Mobile user not found")
-	MobileUserBadCodeErr = NewApiErr(ECodeMobileUserBadCode, "Mobile user bad code")
-	MobileUserBadTokenErr = NewApiErr(ECodeMobileUserBadToken, "Mobile user bad token")
-	MobileUserAlreadyExistsErr = NewApiErr(ECodeMobileUserAlreadyExists, "Mobile user already exists")
+	registerErrCode(ECodeOK, "OK")
+	registerErrCode(ECodeRedirect, "Redirect")
+	registerErrCode(ECodeBadRequest, "Bad request")
+	registerErrCode(ECodePayloadTooLarge, "Payload too large")
+	registerErrCode(ECodeUnsupportedMediaType, "Unsupported media type")
+	registerErrCode(ECode3rdPartyAuthFailed, "3rd party auth failed")
+	NotFoundErr = newBuiltinErr(ECodeNotFound, "NotFound error")
+	UnauthorizedErr = newBuiltinErr(ECodeUnauthorized, "Unauthorized error")
+	ForbiddenErr = newBuiltinErr(ECodeForbidden, "Forbidden error")
+	InternalErr = newBuiltinErr(ECodeInternal, "Internal error")
+	TimeoutErr = newBuiltinErr(ECodeTimeout, "Timeout error")
+	TooManyRequestsErr = newBuiltinErr(ECodeTooManyRequests, "Too many requests")
+	InvalidUsernameErr = newBuiltinErr(ECodeInvalidUsername, "Invalid username")
+	InvalidNicknameErr = newBuiltinErr(ECodeInvalidNickname, "Invalid nickname")
+	InvalidPasswordErr = newBuiltinErr(ECodeInvalidPassword, "Invalid password")
+	MobileUserNotFoundErr = newBuiltinErr(ECodeMobileUserNotFound, "Mobile user not found")
+	MobileUserBadCodeErr = newBuiltinErr(ECodeMobileUserBadCode, "Mobile user bad code")
+	MobileUserBadTokenErr = newBuiltinErr(ECodeMobileUserBadToken, "Mobile user bad token")
+	MobileUserAlreadyExistsErr = newBuiltinErr(ECodeMobileUserAlreadyExists, "Mobile user already exists")
+	SmsCooldownErr = newBuiltinErr(ECodeSmsCooldown, "SMS code sent too recently")
+	SmsQuotaExceededErr = newBuiltinErr(ECodeSmsQuotaExceeded, "SMS code quota exceeded")
+	SmsCodeExpiredErr = newBuiltinErr(ECodeSmsCodeExpired, "SMS code expired")
+	AccountLockedErr = newBuiltinErr(ECodeAccountLocked, "Account temporarily locked")
+	IdentityTakenErr = newBuiltinErr(ECodeIdentityTaken, "Identity linked to another user")
+	ProviderLinkedErr = newBuiltinErr(ECodeProviderLinked, "Another identity of the provider is linked")
+	LastLoginMethodErr = newBuiltinErr(ECodeLastLoginMethod, "Can't unlink the last login method")
+	AddErrTranslations("zh", builtinMsgsZh)
 }
 
 type ApiError struct {
 	Code ErrCode `json:"errcode"`
 	Msg  string  `json:"errmsg"`
+	// Errors of individual input fields
+	Details []*ErrorDetail `json:"details,omitempty"`
+	// Anything else clients need to handle the error
+	Data interface{} `json:"data,omitempty"`
+	// Seconds, sent as the Retry-After header if not 0
+	RetryAfter int `json:"-"`
+}
+
+type ErrorDetail struct {
+	Field string `json:"field"`
+	// Machine readable reason, e.g. the failed validation rule
+	Reason string `json:"reason"`
+	Msg    string `json:"msg,omitempty"`
 }
 
 func (e *ApiError) Error() string {
 	return e.Msg
 }
 
+// HttpCode maps errcodes to HTTP statuses, app specific codes (6xxxx)
+// are client errors.
 func (e *ApiError) HttpCode() int {
-	return int(e.Code) / 100
+	code := int(e.Code) / 100
+	if code >= 600 {
+		return http.StatusBadRequest
+	} else if code < 100 {
+		return http.StatusInternalServerError
+	}
+	return code
+}
+
+// WithRetryAfter returns a copy of e telling clients to retry after seconds
+func (e *ApiError) WithRetryAfter(seconds int) *ApiError {
+	ret := *e
+	ret.RetryAfter = seconds
+	return &ret
 }
 
 func (e *ApiError) HttpError(w http.ResponseWriter) {
@@ -80,16 +144,40 @@ func (e *ApiError) HttpError(w http.ResponseWriter) {
 	}
 }
 
+// WithDetails returns a copy of e with details appended
+func (e *ApiError) WithDetails(details ...*ErrorDetail) *ApiError {
+	ret := *e
+	ret.Details = append(append([]*ErrorDetail(nil), e.Details...), details...)
+	return &ret
+}
+
+// WithData returns a copy of e carrying data
+func (e *ApiError) WithData(data interface{}) *ApiError {
+	ret := *e
+	ret.Data = data
+	return &ret
+}
+
 func NewApiErr(code ErrCode, msg string) *ApiError {
-	return &ApiError{code, msg}
+	return &ApiError{code, msg, nil, nil, 0}
 }
 
+// NewApiErrWithCode uses the registered message of code
 func NewApiErrWithCode(code ErrCode) *ApiError {
-	return &ApiError{code, "No extra info"}
+	msg, ok := ErrMsg(code, "")
+	if !ok {
+		msg = "No extra info"
+	}
+	return &ApiError{code, msg, nil, nil, 0}
 }
 
 func NewApiErrWithMsg(msg string) *ApiError {
-	return &ApiError{ECodeInternal, msg}
+	return &ApiError{ECodeInternal, msg, nil, nil, 0}
+}
+
+func newBuiltinErr(code ErrCode, msg string) *ApiError {
+	registerErrCode(code, msg)
+	return NewApiErr(code, msg)
 }
 
 func ApiErrFromGoErr(err error) *ApiError {
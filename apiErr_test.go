@@ -0,0 +1,29 @@
+package appgo
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestHttpCode(t *testing.T) {
+	cases := []struct {
+		code   ErrCode
+		status int
+	}{
+		{ECodeOK, http.StatusOK},
+		{ECodeNotFound, http.StatusNotFound},
+		{ECodeTooManyRequests, http.StatusTooManyRequests},
+		{ECode3rdPartyAuthFailed, http.StatusServiceUnavailable},
+		// App specific codes are client errors
+		{ECodeInvalidPassword, http.StatusBadRequest},
+		{69999, http.StatusBadRequest},
+		{123456, http.StatusBadRequest},
+		// Codes too small for a status
+		{0, http.StatusInternalServerError},
+		{9999, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.status, NewApiErr(c.code, "").HttpCode(), "code %d", c.code)
+	}
+}
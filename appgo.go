@@ -16,6 +16,8 @@ const CustomVersionHeaderName = "X-Appgo-Api-Version"
 
 const CustomConfVerHeaderName = "X-Appgo-Conf-Version"
 
+const RequestIdHeaderName = "X-Request-Id"
+
 const (
 	RoleAppUser  Role = 100
 	RoleWebUser       = 101
@@ -37,6 +39,7 @@ const (
 	SmsTemplateRegister
 	SmsTemplatePwReset
 	SmsTemplateSetMobile
+	SmsTemplateUnlock
 )
 
 type SmsTemplate int
@@ -56,6 +59,13 @@ type KvStore interface {
 	Get(k string) (string, error)
 }
 
+// KvCounter is implemented by KvStores with atomic counters
+type KvCounter interface {
+	// Incr adds 1 to the counter of k, timeout is set when it's created
+	Incr(k string, timeout int) (int64, error)
+	Del(k string) error
+}
+
 type MobileMsgSender interface {
 	SendMobileCode(mobile string, template SmsTemplate, code string) error
 }
@@ -1,33 +1,43 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/services/apple"
 	"github.com/oxfeeefeee/appgo/services/qq"
 	"github.com/oxfeeefeee/appgo/services/weibo"
 	"github.com/oxfeeefeee/appgo/services/weixin"
+	"time"
 )
 
 var (
 	weixinAppInfo *weixin.AppInfo
 	weiboAppInfo  *weibo.AppInfo
 	qqAppInfo     *qq.AppInfo
+	appleAppInfo  *apple.AppInfo
 
-	userSystem    UserSystem
-	weixinSupport WeixinSupport
-	weiboSupport  WeiboSupport
-	qqSupport     QqSupport
-	mobileSupport MobileSupport
-	oauthSupport  OAuthSupport
+	userSystem     UserSystem
+	weixinSupport  WeixinSupport
+	weiboSupport   WeiboSupport
+	qqSupport      QqSupport
+	mobileSupport  MobileSupport
+	oauthSupport   OAuthSupport
+	refreshSupport RefreshSupport
+	appleSupport   AppleSupport
+	oidcSupport    OidcSupport
 )
 
 type LoginResult struct {
-	UserId   appgo.Id
-	Token    Token
-	UserInfo interface{}
-	Banned   bool
-	BanInfo  interface{}
+	UserId         appgo.Id
+	Token          Token
+	TokenExpires   time.Time
+	RefreshToken   RefreshToken
+	RefreshExpires time.Time
+	UserInfo       interface{}
+	Banned         bool
+	BanInfo        interface{}
 }
 
 type UserSystem interface {
@@ -51,12 +61,20 @@ type QqSupport interface {
 	AddQqUser(info *qq.UserInfo) (uid appgo.Id, err error)
 }
 
+type AppleSupport interface {
+	GetAppleUser(sub string) (uid appgo.Id, err error)
+	AddAppleUser(info *apple.UserInfo) (uid appgo.Id, err error)
+}
+
 type OAuthSupport interface {
 	GetOAuthUser(index int, id string) (uid appgo.Id, err error)
 	GetOAuthUserInfo(index int, code string) (interface{}, string, error)
 	AddOAuthUser(index int, id string, info interface{}) (uid appgo.Id, err error)
 }
 
+// Init takes the supports of logins, newer features (RefreshSupport,
+// AppleSupport, OidcSupport and LinkSupport) are enabled if us implements
+// them, so the signature doesn't change with every feature.
 func Init(us UserSystem, wx WeixinSupport, wb WeiboSupport,
 	qqsp QqSupport, mobile MobileSupport, oauth OAuthSupport) {
 	userSystem = us
@@ -65,6 +83,22 @@ func Init(us UserSystem, wx WeixinSupport, wb WeiboSupport,
 	qqSupport = qqsp
 	mobileSupport = mobile
 	oauthSupport = oauth
+	refreshSupport, _ = us.(RefreshSupport)
+	appleSupport, _ = us.(AppleSupport)
+	oidcSupport, _ = us.(OidcSupport)
+	// Racy counters let clients get around the limits
+	racy := false
+	if _, ok := mobile.(appgo.KvCounter); mobile != nil && !ok {
+		racy = true
+	}
+	if _, ok := oidcSupport.(appgo.KvCounter); oidcSupport != nil && !ok {
+		racy = true
+	}
+	if racy {
+		log.Warnln("Deprecated: KvStores without Incr and Del, counters of " +
+			"SMS codes, logins and oidc states are not atomic, use an appgo.KvCounter")
+	}
+	initJwt()
 	if wx != nil {
 		weixinAppInfo = &weixin.AppInfo{
 			appgo.Conf.Weixin.AppId,
@@ -92,23 +126,32 @@ func Init(us UserSystem, wx WeixinSupport, wb WeiboSupport,
 			log.Panicln("Bad qq config")
 		}
 	}
+	if oidcSupport != nil {
+		initOidc()
+	}
+	if appleSupport != nil && len(appgo.Conf.Apple.ClientIds) > 0 {
+		appleAppInfo = &apple.AppInfo{
+			appgo.Conf.Apple.ClientIds,
+			apple.RemoteKeys(appgo.Conf.Apple.JwksUrl, appgo.Conf.Apple.JwksCacheSeconds),
+			appgo.Conf.Apple.RequireNonce,
+		}
+	}
 }
 
 func LoginByWeixin(openId, token, code string, role appgo.Role) (*LoginResult, error) {
+	return LoginByWeixinCtx(context.Background(), openId, token, code, role)
+}
+
+// LoginByWeixinCtx is LoginByWeixin with requests to weixin traced as part
+// of ctx
+func LoginByWeixinCtx(ctx context.Context,
+	openId, token, code string, role appgo.Role) (*LoginResult, error) {
 	if weixinSupport == nil {
 		return nil, errors.New("weixin login not supported")
 	}
-	if openId == "" || token == "" {
-		params := &weixin.AccessTokenParams{*weixinAppInfo, code}
-		at := weixin.GetAccessToken(params)
-		if at == nil {
-			return nil, errors.New("Failed to get access token")
-		}
-		openId, token = at.OpenId, at.AccessToken
-	}
-	winfo := weixin.GetUserInfo(openId, token)
-	if winfo == nil {
-		return nil, errors.New("Failed to get weixin user info")
+	winfo, err := weixinUser(ctx, openId, token, code)
+	if err != nil {
+		return nil, err
 	}
 	uid, err := weixinSupport.GetWeixinUser(winfo.UnionId)
 	if err != nil {
@@ -124,23 +167,26 @@ func LoginByWeixin(openId, token, code string, role appgo.Role) (*LoginResult, e
 }
 
 func LoginByWeibo(openId, token, code string, role appgo.Role) (*LoginResult, error) {
+	return LoginByWeiboCtx(context.Background(), openId, token, code, role)
+}
+
+// LoginByWeiboCtx is LoginByWeibo with requests to weibo traced as part
+// of ctx
+func LoginByWeiboCtx(ctx context.Context,
+	openId, token, code string, role appgo.Role) (*LoginResult, error) {
 	if weiboSupport == nil {
 		return nil, errors.New("weibo login not supported")
 	}
-	if openId == "" || token == "" {
-		params := &weibo.AccessTokenParams{*weiboAppInfo, code}
-		at := weibo.GetAccessToken(params)
-		if at == nil {
-			return nil, errors.New("Failed to get access token")
-		}
-		openId, token = at.Id, at.AccessToken
+	openId, token, err := weiboToken(ctx, openId, token, code)
+	if err != nil {
+		return nil, err
 	}
 	uid, err := weiboSupport.GetWeiboUser(openId)
 	if err != nil {
 		return nil, err
 	}
 	if uid == 0 {
-		winfo := weibo.GetUserInfo(openId, token)
+		winfo := weibo.GetUserInfoCtx(ctx, openId, token)
 		if winfo == nil {
 			return nil, errors.New("Failed to get weibo user info")
 		}
@@ -153,6 +199,12 @@ func LoginByWeibo(openId, token, code string, role appgo.Role) (*LoginResult, er
 }
 
 func LoginByQq(openId, token string, role appgo.Role) (*LoginResult, error) {
+	return LoginByQqCtx(context.Background(), openId, token, role)
+}
+
+// LoginByQqCtx is LoginByQq with requests to qq traced as part of ctx
+func LoginByQqCtx(ctx context.Context,
+	openId, token string, role appgo.Role) (*LoginResult, error) {
 	if qqSupport == nil {
 		return nil, errors.New("qq login not supported")
 	}
@@ -164,7 +216,7 @@ func LoginByQq(openId, token string, role appgo.Role) (*LoginResult, error) {
 		return nil, err
 	}
 	if uid == 0 {
-		winfo := qq.GetUserInfo(qqAppInfo, openId, token)
+		winfo := qq.GetUserInfoCtx(ctx, qqAppInfo, openId, token)
 		if winfo == nil {
 			return nil, errors.New("Failed to get qq user info")
 		}
@@ -176,6 +228,47 @@ func LoginByQq(openId, token string, role appgo.Role) (*LoginResult, error) {
 	return checkIn(uid, role)
 }
 
+// LoginByApple verifies the identity token of Sign in with Apple, nonce is
+// checked if not empty or Conf.Apple.RequireNonce is set. Apple only tells
+// the client the name of a user on the first sign in, nickname is used for
+// new users.
+func LoginByApple(identityToken, nonce, nickname string, role appgo.Role) (*LoginResult, error) {
+	return LoginByAppleCtx(context.Background(), identityToken, nonce, nickname, role)
+}
+
+// LoginByAppleCtx is LoginByApple with fetches of Apple's keys traced as
+// part of ctx
+func LoginByAppleCtx(ctx context.Context,
+	identityToken, nonce, nickname string, role appgo.Role) (*LoginResult, error) {
+	if appleSupport == nil || appleAppInfo == nil {
+		return nil, errors.New("apple login not supported")
+	}
+	info, err := appleUser(ctx, identityToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := appleSupport.GetAppleUser(info.Sub)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 {
+		info.Nickname = nickname
+		uid, err = appleSupport.AddAppleUser(info)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return checkIn(uid, role)
+}
+
+// SetAppleKeys replaces the source of Apple's keys, e.g. with
+// apple.StaticKeys in tests
+func SetAppleKeys(keys apple.KeySource) {
+	if appleAppInfo != nil {
+		appleAppInfo.Keys = keys
+	}
+}
+
 func LoginByOAuth(code string, index int, role appgo.Role) (*LoginResult, error) {
 	if oauthSupport == nil {
 		return nil, errors.New("OAuth login not supported")
@@ -197,8 +290,52 @@ func LoginByOAuth(code string, index int, role appgo.Role) (*LoginResult, error)
 	return checkIn(uid, role)
 }
 
+func weixinUser(ctx context.Context, openId, token, code string) (*weixin.UserInfo, error) {
+	if openId == "" || token == "" {
+		params := &weixin.AccessTokenParams{*weixinAppInfo, code}
+		at := weixin.GetAccessTokenCtx(ctx, params)
+		if at == nil {
+			return nil, errors.New("Failed to get access token")
+		}
+		openId, token = at.OpenId, at.AccessToken
+	}
+	winfo := weixin.GetUserInfoCtx(ctx, openId, token)
+	if winfo == nil {
+		return nil, errors.New("Failed to get weixin user info")
+	}
+	return winfo, nil
+}
+
+func weiboToken(ctx context.Context, openId, token, code string) (string, string, error) {
+	if openId == "" || token == "" {
+		params := &weibo.AccessTokenParams{*weiboAppInfo, code}
+		at := weibo.GetAccessTokenCtx(ctx, params)
+		if at == nil {
+			return "", "", errors.New("Failed to get access token")
+		}
+		openId, token = at.Id, at.AccessToken
+	}
+	return openId, token, nil
+}
+
+func appleUser(ctx context.Context, identityToken, nonce string) (*apple.UserInfo, error) {
+	info, err := apple.VerifyIdentityToken(ctx, appleAppInfo, identityToken, nonce)
+	if err != nil {
+		log.WithField("error", err).Infoln("bad apple identity token")
+		return nil, appgo.NewApiErr(appgo.ECode3rdPartyAuthFailed, err.Error())
+	}
+	return info, nil
+}
+
 func checkIn(uid appgo.Id, role appgo.Role) (*LoginResult, error) {
-	token := NewToken(uid, role)
+	return checkInFamily(uid, role, "")
+}
+
+// checkInFamily issues a new token, along with a new refresh token of the
+// given family (a new family if empty) when refresh tokens are enabled.
+func checkInFamily(uid appgo.Id, role appgo.Role, family string) (*LoginResult, error) {
+	expires := TokenExpiry(role)
+	token := newToken(uid, role, expires)
 	banned, info, err := userSystem.CheckIn(uid, role, token)
 	if err != nil {
 		return nil, err
@@ -210,9 +347,17 @@ func checkIn(uid appgo.Id, role appgo.Role) (*LoginResult, error) {
 			BanInfo: info,
 		}, nil
 	}
-	return &LoginResult{
-		UserId:   uid,
-		Token:    token,
-		UserInfo: info,
-	}, nil
+	ret := &LoginResult{
+		UserId:       uid,
+		Token:        token,
+		TokenExpires: expires,
+		UserInfo:     info,
+	}
+	if RefreshEnabled() {
+		ret.RefreshToken, ret.RefreshExpires, err = newRefreshToken(uid, role, family)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
 }
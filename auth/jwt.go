@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/jwt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// []byte for HS256, crypto.Signer otherwise
+	jwtSignKey   interface{}
+	jwtVerifyKey interface{}
+	jwks         = &jwt.JWKS{Keys: []*jwt.JWK{}}
+)
+
+type jwtClaims struct {
+	jwt.StandardClaims
+	Role appgo.Role `json:"role"`
+}
+
+// Jwks returns the public keys JWTs can be verified with, the set is empty
+// if JWT mode is off or HS256 is used.
+func Jwks() *jwt.JWKS {
+	return jwks
+}
+
+func jwtEnabled() bool {
+	return jwtSignKey != nil
+}
+
+func initJwt() {
+	conf := appgo.Conf.Jwt
+	if !conf.Enable {
+		return
+	}
+	switch conf.Alg {
+	case jwt.HS256:
+		if len(conf.Secret) < 32 {
+			log.Panicln("JWT secret should be at least 32 bytes")
+		}
+		jwtSignKey, jwtVerifyKey = []byte(conf.Secret), []byte(conf.Secret)
+	case jwt.RS256, jwt.ES256:
+		path := conf.PrivateKeyFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(appgo.RootDir, path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.WithField("error", err).Panicln("Failed to read JWT private key")
+		}
+		key, err := jwt.ParsePrivateKey(data)
+		if err != nil {
+			log.WithField("error", err).Panicln("Failed to parse JWT private key")
+		}
+		jwk, err := jwt.NewJWK(conf.KeyId, conf.Alg, key.Public())
+		if err != nil {
+			log.WithField("error", err).Panicln("Bad JWT private key")
+		}
+		jwtSignKey, jwtVerifyKey = key, key.Public()
+		jwks = &jwt.JWKS{Keys: []*jwt.JWK{jwk}}
+	default:
+		log.Panicln("Unsupported JWT alg: ", conf.Alg)
+	}
+	// Catches keys of the wrong type for alg
+	if _, err := jwt.Sign(&jwtClaims{}, conf.Alg, conf.KeyId, jwtSignKey); err != nil {
+		log.WithField("error", err).Panicln("Bad JWT config")
+	}
+}
+
+func newJwtToken(userId appgo.Id, role appgo.Role, expiresAt time.Time) Token {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		log.WithField("error", err).Errorln("failed to generate jti")
+		return Token("")
+	}
+	conf := appgo.Conf.Jwt
+	claims := &jwtClaims{
+		jwt.StandardClaims{
+			Issuer:    conf.Issuer,
+			Subject:   userId.String(),
+			ExpiresAt: expiresAt.Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Id:        hex.EncodeToString(jti),
+		},
+		role,
+	}
+	str, err := jwt.Sign(claims, conf.Alg, conf.KeyId, jwtSignKey)
+	if err != nil {
+		log.WithField("error", err).Errorln("failed to sign token")
+		return Token("")
+	}
+	return Token(str)
+}
+
+func jwtTokenClaims(t Token) *TokenClaims {
+	if !jwtEnabled() {
+		log.Infoln("validate token failed: JWT mode is off")
+		return nil
+	}
+	var claims jwtClaims
+	header, err := jwt.Parse(string(t), jwtKeyFunc, &claims)
+	if err != nil {
+		log.Infoln("validate token failed: ", err)
+		return nil
+	}
+	if err := claims.Valid(time.Now()); err != nil {
+		log.Infoln("validate token failed: ", err)
+		return nil
+	}
+	if claims.Issuer != appgo.Conf.Jwt.Issuer {
+		log.Infoln("validate token failed: bad issuer ", claims.Issuer)
+		return nil
+	}
+	userId := appgo.IdFromStr(claims.Subject)
+	if userId == 0 {
+		log.Infoln("validate token failed: bad subject ", claims.Subject)
+		return nil
+	}
+	return &TokenClaims{
+		UserId:  userId,
+		Role:    claims.Role,
+		Expires: time.Unix(claims.ExpiresAt, 0),
+		KeyId:   header.Kid,
+	}
+}
+
+func jwtKeyFunc(h *jwt.Header) (interface{}, error) {
+	conf := appgo.Conf.Jwt
+	if h.Alg != conf.Alg {
+		return nil, jwt.ErrBadAlg
+	}
+	if h.Kid != conf.KeyId {
+		return nil, jwt.ErrKeyNotFound
+	}
+	return jwtVerifyKey, nil
+}
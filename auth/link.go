@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/services/qq"
+	"github.com/oxfeeefeee/appgo/services/weibo"
+	"strconv"
+	"strings"
+)
+
+// Providers of identities besides oidc providers, which go by their names
+const (
+	ProviderMobile = "mobile"
+	ProviderWeixin = "weixin"
+	ProviderWeibo  = "weibo"
+	ProviderQq     = "qq"
+	ProviderApple  = "apple"
+	// Followed by the index of LoginByOAuth
+	ProviderOAuthPrefix = "oauth"
+)
+
+// LinkSupport is implemented by UserSystems that can link identities to
+// existing users. Linking fails with IdentityTakenErr if the identity is
+// linked to another user, and with ProviderLinkedErr if the user has
+// another identity of provider. Unlinking fails with LastLoginMethodErr.
+type LinkSupport interface {
+	LinkIdentity(uid appgo.Id, provider, subject string) error
+	UnlinkIdentity(uid appgo.Id, provider string) error
+}
+
+func OAuthProvider(index int) string {
+	return ProviderOAuthPrefix + strconv.Itoa(index)
+}
+
+func BindWeixin(ctx context.Context, uid appgo.Id, openId, token, code string) error {
+	ls, err := linkSupport(weixinSupport != nil)
+	if err != nil {
+		return err
+	}
+	winfo, err := weixinUser(ctx, openId, token, code)
+	if err != nil {
+		return err
+	}
+	return ls.LinkIdentity(uid, ProviderWeixin, winfo.UnionId)
+}
+
+// BindWeibo links the owner of token, or of the token of code if token is
+// empty, to uid
+func BindWeibo(ctx context.Context, uid appgo.Id, token, code string) error {
+	ls, err := linkSupport(weiboSupport != nil)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		params := &weibo.AccessTokenParams{*weiboAppInfo, code}
+		at := weibo.GetAccessTokenCtx(ctx, params)
+		if at == nil {
+			return errors.New("Failed to get access token")
+		}
+		token = at.AccessToken
+	}
+	// Clients can send any uid along with the token, only weibo knows
+	// whose it is
+	info := weibo.GetTokenInfoCtx(ctx, token)
+	if info == nil || info.AppKey != weiboAppInfo.AppId {
+		return appgo.NewApiErr(appgo.ECode3rdPartyAuthFailed, "bad weibo token")
+	}
+	return ls.LinkIdentity(uid, ProviderWeibo, strconv.FormatInt(info.Uid, 10))
+}
+
+// BindQq links the owner of token to uid
+func BindQq(ctx context.Context, uid appgo.Id, token string) error {
+	ls, err := linkSupport(qqSupport != nil)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("BindQq: bad token")
+	}
+	// Clients can send any openid along with the token, only qq knows
+	// whose it is
+	info := qq.GetOpenIdCtx(ctx, token)
+	if info == nil || info.ClientId != qqAppInfo.AppId {
+		return appgo.NewApiErr(appgo.ECode3rdPartyAuthFailed, "bad qq token")
+	}
+	return ls.LinkIdentity(uid, ProviderQq, info.OpenId)
+}
+
+func BindApple(ctx context.Context, uid appgo.Id, identityToken, nonce string) error {
+	ls, err := linkSupport(appleSupport != nil && appleAppInfo != nil)
+	if err != nil {
+		return err
+	}
+	info, err := appleUser(ctx, identityToken, nonce)
+	if err != nil {
+		return err
+	}
+	return ls.LinkIdentity(uid, ProviderApple, info.Sub)
+}
+
+func BindOAuth(ctx context.Context, uid appgo.Id, code string, index int) error {
+	ls, err := linkSupport(oauthSupport != nil)
+	if err != nil {
+		return err
+	}
+	_, id, err := oauthSupport.GetOAuthUserInfo(index, code)
+	if err != nil {
+		return err
+	}
+	return ls.LinkIdentity(uid, OAuthProvider(index), id)
+}
+
+// BindOidc finishes a binding started by OidcBindUrl of the same uid
+func BindOidc(ctx context.Context, uid appgo.Id, provider, code, state string) error {
+	ls, err := linkSupport(oidcSupport != nil)
+	if err != nil {
+		return err
+	}
+	info, err := oidcUser(ctx, provider, code, state, oidcPurposeBind, uid)
+	if err != nil {
+		return err
+	}
+	return ls.LinkIdentity(uid, provider, info.Subject)
+}
+
+// Unbind unlinks the identity of provider from uid, mobiles can be
+// unbound too
+func Unbind(uid appgo.Id, provider string) error {
+	ls, err := linkSupport(true)
+	if err != nil {
+		return err
+	}
+	return ls.UnlinkIdentity(uid, provider)
+}
+
+func linkSupport(supported bool) (LinkSupport, error) {
+	ls, ok := userSystem.(LinkSupport)
+	if !ok || !supported {
+		return nil, errors.New("binding not supported")
+	}
+	return ls, nil
+}
+
+func isBuiltinProvider(name string) bool {
+	switch name {
+	case ProviderMobile, ProviderWeixin, ProviderWeibo, ProviderQq, ProviderApple:
+		return true
+	}
+	return strings.HasPrefix(name, ProviderOAuthPrefix)
+}
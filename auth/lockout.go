@@ -0,0 +1,183 @@
+package auth
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"strconv"
+	"time"
+)
+
+const (
+	loginFailKeyPrefix   = "loginfail:"
+	loginIpFailKeyPrefix = "loginipfail:"
+	loginDelayKeyPrefix  = "logindelay:"
+	loginLockKeyPrefix   = "loginlock:"
+
+	// See Conf.Login
+	defaultLoginFailureWindow = 60 * 60
+	defaultLoginDelayAfter    = 3
+	defaultLoginMaxDelay      = 30
+	defaultLoginMaxFailures   = 10
+	defaultLoginLockout       = 15 * 60
+	defaultLoginIpMaxFailures = 50
+)
+
+// Reasons of failed LoginEvents
+const (
+	LoginFailPassword  = "password"
+	LoginFailNotFound  = "not_found"
+	LoginFailLocked    = "locked"
+	LoginFailThrottled = "throttled"
+	LoginFailError     = "error"
+)
+
+// LoginEvent is a password login attempt
+type LoginEvent struct {
+	Time    time.Time
+	Method  string
+	Account string
+	Ip      string
+	UserId  appgo.Id
+	Success bool
+	// One of LoginFail*, empty on success
+	Reason string
+}
+
+var loginListeners []func(*LoginEvent)
+
+// OnLoginAttempt registers f to be called with every password login
+// attempt, e.g. to keep an audit trail. Attempts are logged anyway.
+// Not safe to call once logins are served.
+func OnLoginAttempt(f func(*LoginEvent)) {
+	loginListeners = append(loginListeners, f)
+}
+
+// UnlockLogin clears the failures, delay and lockout of account
+func UnlockLogin(account string) error {
+	for _, prefix := range []string{
+		loginLockKeyPrefix, loginDelayKeyPrefix, loginFailKeyPrefix} {
+		if err := appgo.KvDel(mobileSupport, prefix+account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLogin rejects attempts on locked or delayed accounts, and from IPs
+// with too many failures.
+func checkLogin(account, ip string) (string, error) {
+	if wait, err := waitFor(loginLockKeyPrefix + account); err != nil {
+		return LoginFailError, err
+	} else if wait > 0 {
+		return LoginFailLocked, retryAfter(appgo.AccountLockedErr, wait)
+	}
+	if wait, err := waitFor(loginDelayKeyPrefix + account); err != nil {
+		return LoginFailError, err
+	} else if wait > 0 {
+		return LoginFailThrottled, retryAfter(appgo.TooManyRequestsErr, wait)
+	}
+	if ip == "" {
+		return "", nil
+	}
+	c := &appgo.Conf.Login
+	if v, err := mobileSupport.Get(loginIpFailKeyPrefix + ip); err != nil {
+		return LoginFailError, err
+	} else if strutil.ToInt(v) >= confOr(c.IpMaxFailures, defaultLoginIpMaxFailures) {
+		return LoginFailThrottled, retryAfter(appgo.TooManyRequestsErr,
+			confOr(c.FailureWindow, defaultLoginFailureWindow))
+	}
+	return "", nil
+}
+
+// loginFailed counts a failure of account and ip, and returns the error of
+// the attempt: fail with a retry hint if the account is delayed from now
+// on, or AccountLockedErr.
+func loginFailed(account, ip string, fail *appgo.ApiError) error {
+	c := &appgo.Conf.Login
+	window := confOr(c.FailureWindow, defaultLoginFailureWindow)
+	if ip != "" {
+		if _, err := appgo.KvIncr(mobileSupport, loginIpFailKeyPrefix+ip, window); err != nil {
+			return err
+		}
+	}
+	n, err := appgo.KvIncr(mobileSupport, loginFailKeyPrefix+account, window)
+	if err != nil {
+		return err
+	}
+	if n >= int64(confOr(c.MaxFailures, defaultLoginMaxFailures)) {
+		lockout := confOr(c.Lockout, defaultLoginLockout)
+		if err := setWait(loginLockKeyPrefix+account, lockout); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"account": account,
+			"ip":      ip,
+		}).Warnln("login locked")
+		// Counting starts over once the lockout ends
+		if err := appgo.KvDel(mobileSupport, loginFailKeyPrefix+account); err != nil {
+			return err
+		}
+		return retryAfter(appgo.AccountLockedErr, lockout)
+	}
+	delayAfter := int64(confOr(c.DelayAfter, defaultLoginDelayAfter))
+	if n < delayAfter {
+		return fail
+	}
+	maxDelay := confOr(c.MaxDelay, defaultLoginMaxDelay)
+	delay := maxDelay
+	if shift := n - delayAfter; shift < 30 && 1<<uint(shift) < maxDelay {
+		delay = 1 << uint(shift)
+	}
+	if err := setWait(loginDelayKeyPrefix+account, delay); err != nil {
+		return err
+	}
+	return retryAfter(fail, delay)
+}
+
+// loginSucceeded forgets the failures of account, not of the IP, which
+// may be trying many accounts.
+func loginSucceeded(account string) error {
+	for _, prefix := range []string{loginDelayKeyPrefix, loginFailKeyPrefix} {
+		if err := appgo.KvDel(mobileSupport, prefix+account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setWait stores when k ends, so waitFor can tell the remaining seconds
+func setWait(k string, seconds int) error {
+	until := time.Now().Unix() + int64(seconds)
+	return mobileSupport.Set(k, strconv.FormatInt(until, 10), seconds)
+}
+
+func waitFor(k string) (int, error) {
+	v, err := mobileSupport.Get(k)
+	if err != nil || v == "" {
+		return 0, err
+	}
+	until, _ := strconv.ParseInt(v, 10, 64)
+	if wait := until - time.Now().Unix(); wait > 0 {
+		return int(wait), nil
+	}
+	return 0, nil
+}
+
+func emitLoginEvent(e *LoginEvent) {
+	fields := log.Fields{
+		"method":  e.Method,
+		"account": e.Account,
+		"ip":      e.Ip,
+		"userId":  e.UserId,
+	}
+	if e.Success {
+		log.WithFields(fields).Infoln("login succeeded")
+	} else {
+		fields["reason"] = e.Reason
+		log.WithFields(fields).Warnln("login failed")
+	}
+	for _, f := range loginListeners {
+		f(e)
+	}
+}
@@ -1,19 +1,32 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"errors"
-	///log "github.com/Sirupsen/logrus"
+	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
 	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+	"sync"
+	"time"
 )
 
 const (
-	mobileCodeLen        = 6
-	mobileTokenLen       = 16
-	mobileCodeTimeout    = 2 * 60
-	mobileTokenTimeout   = 10 * 60
-	mobileCodeKeyPrefix  = "mobilecode:"
-	mobileTokenKeyPrefix = "mobiletoken:"
+	mobileTokenLen           = 16
+	mobileTokenTimeout       = 10 * 60
+	mobileCodeKeyPrefix      = "mobilecode:"
+	mobileTokenKeyPrefix     = "mobiletoken:"
+	mobileTokenUsedKeyPrefix = "mobiletokenused:"
+	smsCooldownKeyPrefix     = "smscooldown:"
+	smsQuotaKeyPrefix        = "smsquota:"
+	smsAttemptsKeyPrefix     = "smsattempts:"
+	smsUsedKeyPrefix         = "smsused:"
+
+	// See Conf.Sms
+	defaultSmsCodeLen     = 6
+	defaultSmsCodeTtl     = 2 * 60
+	defaultSmsCooldown    = 60
+	defaultSmsDailyQuota  = 10
+	defaultSmsMaxAttempts = 5
 )
 
 type MobileUserInfo struct {
@@ -25,6 +38,8 @@ type MobileUserInfo struct {
 	Sex      appgo.Sex
 }
 
+// MobileSupport stores mobile users, GetMobileUser returns the uid along
+// with appgo.InvalidPasswordErr so failed logins can be attributed
 type MobileSupport interface {
 	HasMobileUser(mobile string) (bool, error)
 	GetMobileUser(mobile, password string) (uid appgo.Id, err error)
@@ -53,6 +68,10 @@ func MobileVerifyRegister(mobile, code string) (string, error) {
 		mobileTokenKeyPrefix+mobile, token, mobileTokenTimeout); err != nil {
 		return "", err
 	}
+	// The new token can be used once
+	if err := appgo.KvDel(mobileSupport, mobileTokenUsedKeyPrefix+mobile); err != nil {
+		return "", err
+	}
 	return token, nil
 }
 
@@ -72,14 +91,27 @@ func MobileVerifySet(mobile string, id appgo.Id, code string) error {
 	return mobileSupport.SetMobileForUser(mobile, id)
 }
 
+// MobileRegisterUser takes the token of MobileVerifyRegister, which can
+// only be used once
 func MobileRegisterUser(info *MobileUserInfo, role appgo.Role) (*LoginResult, error) {
-	stoken, err := mobileSupport.Get(mobileTokenKeyPrefix + info.Mobile)
+	key := mobileTokenKeyPrefix + info.Mobile
+	stoken, err := mobileSupport.Get(key)
 	if err != nil {
 		return nil, err
 	}
-	if stoken != info.Token {
+	if stoken == "" || subtle.ConstantTimeCompare([]byte(stoken), []byte(info.Token)) != 1 {
+		return nil, appgo.MobileUserBadTokenErr
+	}
+	// Guards against concurrent uses, deleting the token alone doesn't
+	if n, err := appgo.KvIncr(mobileSupport,
+		mobileTokenUsedKeyPrefix+info.Mobile, mobileTokenTimeout); err != nil {
+		return nil, err
+	} else if n > 1 {
 		return nil, appgo.MobileUserBadTokenErr
 	}
+	if err := appgo.KvDel(mobileSupport, key); err != nil {
+		return nil, err
+	}
 	uid, err := mobileSupport.AddMobileUser(info)
 	if err != nil {
 		return nil, err
@@ -103,41 +135,150 @@ func MobileVerifyPwReset(mobile, code, password string) error {
 	if err := mobileSupport.UpdatePwByMobile(mobile, password); err != nil {
 		return err
 	}
-	return nil
+	return UnlockLogin(mobile)
 }
 
+var loginByMobileWarning sync.Once
+
+// Deprecated: LoginByMobile can't throttle failed attempts by IP, use
+// LoginByMobileFrom with e.g. server.ClientIp.
 func LoginByMobile(mobile, password string, role appgo.Role) (*LoginResult, error) {
+	loginByMobileWarning.Do(func() {
+		log.Warnln("LoginByMobile is deprecated, failed logins are not throttled by IP, use LoginByMobileFrom")
+	})
+	return LoginByMobileFrom(mobile, password, "", role)
+}
+
+// LoginByMobileFrom throttles failed attempts by account and by ip, which
+// can be empty. Accounts are locked after Conf.Login.MaxFailures, until
+// MobileVerifyUnlock, MobileVerifyPwReset or an admin unlocks them.
+func LoginByMobileFrom(mobile, password, ip string, role appgo.Role) (*LoginResult, error) {
 	if mobileSupport == nil {
 		return nil, errors.New("mobile not supported")
 	}
+	event := &LoginEvent{Time: time.Now(), Method: "mobile", Account: mobile, Ip: ip}
+	defer emitLoginEvent(event)
+	if reason, err := checkLogin(mobile, ip); err != nil {
+		event.Reason = reason
+		return nil, err
+	}
 	uid, err := mobileSupport.GetMobileUser(mobile, password)
-	if err != nil {
+	if err == appgo.InvalidPasswordErr {
+		event.UserId, event.Reason = uid, LoginFailPassword
+		return nil, loginFailed(mobile, ip, appgo.InvalidPasswordErr)
+	} else if err != nil {
+		event.Reason = LoginFailError
 		return nil, err
 	}
 	if uid == 0 {
+		// Only counted for the IP, there's no account to lock
+		event.Reason = LoginFailNotFound
+		if ip != "" {
+			if _, err := appgo.KvIncr(mobileSupport, loginIpFailKeyPrefix+ip,
+				confOr(appgo.Conf.Login.FailureWindow, defaultLoginFailureWindow)); err != nil {
+				return nil, err
+			}
+		}
 		return nil, appgo.MobileUserNotFoundErr
 	}
-	return checkIn(uid, role)
+	if err := loginSucceeded(mobile); err != nil {
+		event.Reason = LoginFailError
+		return nil, err
+	}
+	ret, err := checkIn(uid, role)
+	if err != nil {
+		event.Reason = LoginFailError
+		return nil, err
+	}
+	event.UserId, event.Success = uid, true
+	return ret, nil
 }
 
+func MobilePreUnlock(mobile string) (string, error) {
+	if has, err := mobileSupport.HasMobileUser(mobile); err != nil {
+		return "", err
+	} else if !has {
+		return "", appgo.MobileUserNotFoundErr
+	}
+	return sendSmsCode(mobile, 0, appgo.SmsTemplateUnlock)
+}
+
+func MobileVerifyUnlock(mobile, code string) error {
+	if err := verifySmsCode(mobile, 0, code); err != nil {
+		return err
+	}
+	return UnlockLogin(mobile)
+}
+
+// sendSmsCode enforces the cooldown and daily quota of mobile
 func sendSmsCode(mobile string, id appgo.Id, template appgo.SmsTemplate) (string, error) {
-	code := crypto.RandNumStr(mobileCodeLen)
-	if err := mobileSupport.Set(
-		smsCodeKey(mobile, id), code, mobileCodeTimeout); err != nil {
+	c := &appgo.Conf.Sms
+	cooldown := confOr(c.Cooldown, defaultSmsCooldown)
+	if n, err := appgo.KvIncr(mobileSupport,
+		smsCooldownKeyPrefix+mobile, cooldown); err != nil {
 		return "", err
+	} else if n > 1 {
+		return "", retryAfter(appgo.SmsCooldownErr, cooldown)
+	}
+	now := time.Now()
+	if n, err := appgo.KvIncr(mobileSupport,
+		smsQuotaKeyPrefix+mobile+":"+now.Format("20060102"), 24*60*60); err != nil {
+		return "", err
+	} else if n > int64(confOr(c.DailyQuota, defaultSmsDailyQuota)) {
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		return "", retryAfter(appgo.SmsQuotaExceededErr, int(tomorrow.Sub(now)/time.Second)+1)
+	}
+	key := smsCodeKey(mobile, id)
+	code := crypto.RandNumStr(confOr(c.CodeLen, defaultSmsCodeLen))
+	if err := mobileSupport.Set(key, code, confOr(c.CodeTtl, defaultSmsCodeTtl)); err != nil {
+		return "", err
+	}
+	// The new code gets its own attempts
+	for _, k := range []string{smsAttemptsKeyPrefix + key, smsUsedKeyPrefix + key} {
+		if err := appgo.KvDel(mobileSupport, k); err != nil {
+			return "", err
+		}
 	}
 	return code, mobileSupport.SendMobileCode(mobile, template, code)
 }
 
+// verifySmsCode burns the code after too many wrong guesses, codes can only
+// be used once.
 func verifySmsCode(mobile string, id appgo.Id, code string) error {
-	scode, err := mobileSupport.Get(smsCodeKey(mobile, id))
+	c := &appgo.Conf.Sms
+	ttl := confOr(c.CodeTtl, defaultSmsCodeTtl)
+	key := smsCodeKey(mobile, id)
+	scode, err := mobileSupport.Get(key)
 	if err != nil {
 		return err
 	}
-	if scode != code {
+	if scode == "" {
+		return appgo.SmsCodeExpiredErr
+	}
+	if subtle.ConstantTimeCompare([]byte(scode), []byte(code)) != 1 {
+		n, err := appgo.KvIncr(mobileSupport, smsAttemptsKeyPrefix+key, ttl)
+		if err != nil {
+			return err
+		}
+		if n >= int64(confOr(c.MaxAttempts, defaultSmsMaxAttempts)) {
+			if err := appgo.KvDel(mobileSupport, key); err != nil {
+				return err
+			}
+			return appgo.SmsCodeExpiredErr
+		}
 		return appgo.MobileUserBadCodeErr
 	}
-	return nil
+	// Guards against concurrent uses, deleting the code alone doesn't
+	if n, err := appgo.KvIncr(mobileSupport, smsUsedKeyPrefix+key, ttl); err != nil {
+		return err
+	} else if n > 1 {
+		return appgo.SmsCodeExpiredErr
+	}
+	return appgo.KvDel(mobileSupport, key)
+}
+
+func retryAfter(err *appgo.ApiError, seconds int) *appgo.ApiError {
+	return err.WithRetryAfter(seconds).WithData(map[string]int{"retryAfter": seconds})
 }
 
 func smsCodeKey(mobile string, id appgo.Id) string {
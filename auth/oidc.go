@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/services/oidc"
+)
+
+const (
+	oidcStateKeyPrefix = "oidcstate:"
+	oidcUsedKeyPrefix  = "oidcused:"
+	oidcStateTimeout   = 10 * 60
+
+	// Purposes of states, a state can only finish what it started
+	oidcPurposeLogin = "login"
+	oidcPurposeBind  = "bind"
+)
+
+// OidcSupport stores identities of oidc providers, keyed by provider name
+// and subject
+type OidcSupport interface {
+	GetIdentityUser(provider, subject string) (uid appgo.Id, err error)
+	AddIdentityUser(info *oidc.UserInfo) (uid appgo.Id, err error)
+	appgo.KvStore
+}
+
+type oidcState struct {
+	Provider string
+	Nonce    string
+	Verifier string
+	Purpose  string
+	// The user binding the identity, 0 for logins
+	Uid appgo.Id
+}
+
+// OidcAuthUrl starts a login with provider, clients are sent to the
+// returned URL, then the provider sends them to its redirect URL with the
+// code and state for LoginByOidc. Apps need to tie the state to the user
+// agent that started the login, e.g. with a cookie checked before
+// LoginByOidc, otherwise an attacker can log victims into the attacker's
+// account by sending them the redirect URL.
+func OidcAuthUrl(ctx context.Context, provider string) (string, error) {
+	return oidcAuthUrl(ctx, provider, oidcPurposeLogin, 0)
+}
+
+// OidcBindUrl is OidcAuthUrl for BindOidc of user uid, the state is only
+// accepted by BindOidc of the same user.
+func OidcBindUrl(ctx context.Context, uid appgo.Id, provider string) (string, error) {
+	if uid == 0 {
+		return "", errors.New("OidcBindUrl: bad uid")
+	}
+	return oidcAuthUrl(ctx, provider, oidcPurposeBind, uid)
+}
+
+func oidcAuthUrl(ctx context.Context, provider, purpose string,
+	uid appgo.Id) (string, error) {
+	p, err := oidcProvider(provider)
+	if err != nil {
+		return "", err
+	}
+	state, nonce, verifier, err := oidc.NewState()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&oidcState{provider, nonce, verifier, purpose, uid})
+	if err != nil {
+		return "", err
+	}
+	if err := oidcSupport.Set(
+		oidcStateKeyPrefix+state, string(data), oidcStateTimeout); err != nil {
+		return "", err
+	}
+	return p.AuthCodeUrl(ctx, state, nonce, verifier)
+}
+
+// LoginByOidc finishes a login started by OidcAuthUrl, states can only be
+// used once
+func LoginByOidc(ctx context.Context, provider, code, state string, role appgo.Role) (*LoginResult, error) {
+	info, err := oidcUser(ctx, provider, code, state, oidcPurposeLogin, 0)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := oidcSupport.GetIdentityUser(provider, info.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 {
+		uid, err = oidcSupport.AddIdentityUser(info)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return checkIn(uid, role)
+}
+
+// oidcUser takes state, which must have been issued for provider, purpose
+// and uid
+func oidcUser(ctx context.Context, provider, code, state, purpose string,
+	uid appgo.Id) (*oidc.UserInfo, error) {
+	p, err := oidcProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	s, err := takeOidcState(state)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.Provider != provider || s.Purpose != purpose || s.Uid != uid {
+		return nil, appgo.NewApiErr(appgo.ECode3rdPartyAuthFailed, "bad oidc state")
+	}
+	info, err := p.Exchange(ctx, code, s.Verifier, s.Nonce)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"provider": provider,
+			"error":    err,
+		}).Infoln("oidc exchange failed")
+		return nil, appgo.NewApiErr(appgo.ECode3rdPartyAuthFailed, err.Error())
+	}
+	return info, nil
+}
+
+func initOidc() {
+	for _, c := range appgo.Conf.Oidc {
+		if isBuiltinProvider(c.Name) {
+			log.Panicln("Bad oidc config, provider name taken: ", c.Name)
+		}
+		if _, err := oidc.Register(&oidc.Config{
+			Name:         c.Name,
+			Issuer:       c.Issuer,
+			ClientId:     c.ClientId,
+			ClientSecret: c.ClientSecret,
+			RedirectUrl:  c.RedirectUrl,
+			Scopes:       c.Scopes,
+			AuthUrl:      c.AuthUrl,
+			TokenUrl:     c.TokenUrl,
+			UserInfoUrl:  c.UserInfoUrl,
+			JwksUrl:      c.JwksUrl,
+			Claims:       oidc.ClaimMap(c.Claims),
+			CacheSeconds: c.CacheSeconds,
+		}); err != nil {
+			log.WithField("error", err).Panicln("Bad oidc config")
+		}
+	}
+}
+
+func oidcProvider(name string) (*oidc.Provider, error) {
+	if oidcSupport == nil {
+		return nil, errors.New("oidc login not supported")
+	}
+	p := oidc.Get(name)
+	if p == nil {
+		return nil, appgo.NewApiErr(appgo.ECodeNotFound, oidc.ErrUnknownProvider.Error())
+	}
+	return p, nil
+}
+
+func takeOidcState(state string) (*oidcState, error) {
+	if state == "" {
+		return nil, nil
+	}
+	key := oidcStateKeyPrefix + state
+	data, err := oidcSupport.Get(key)
+	if err != nil || data == "" {
+		return nil, err
+	}
+	// Guards against concurrent uses, deleting the state alone doesn't
+	if n, err := appgo.KvIncr(oidcSupport,
+		oidcUsedKeyPrefix+state, oidcStateTimeout); err != nil || n > 1 {
+		return nil, err
+	}
+	if err := appgo.KvDel(oidcSupport, key); err != nil {
+		return nil, err
+	}
+	var s oidcState
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+	"time"
+)
+
+const (
+	refreshTokenLen        = 32
+	defaultRefreshLifetime = 30 * 24 * 60 * 60
+)
+
+// RefreshToken is an opaque random string, only its hash is stored.
+// Every refresh rotates it, all tokens rotated from the same login
+// share a family which is revoked as a whole when reuse is detected.
+type RefreshToken string
+
+type RefreshTokenInfo struct {
+	UserId    appgo.Id
+	Role      appgo.Role
+	Family    string
+	ExpiresAt time.Time
+}
+
+type RefreshSupport interface {
+	SaveRefreshToken(hash string, info *RefreshTokenInfo) error
+	// UseRefreshToken marks the token as used, info is nil if the token is
+	// unknown, reused is true if it has been used before.
+	UseRefreshToken(hash string) (info *RefreshTokenInfo, reused bool, err error)
+	RevokeRefreshFamily(id appgo.Id, family string) error
+}
+
+func RefreshEnabled() bool {
+	return appgo.Conf.RefreshToken.Enable && refreshSupport != nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token
+func Refresh(token RefreshToken) (*LoginResult, error) {
+	if !RefreshEnabled() {
+		return nil, appgo.NewApiErr(appgo.ECodeNotFound, "refresh token not supported")
+	}
+	info, reused, err := refreshSupport.UseRefreshToken(hashRefreshToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.ExpiresAt.Before(time.Now()) {
+		return nil, appgo.UnauthorizedErr
+	}
+	if reused {
+		log.WithFields(log.Fields{
+			"id":     info.UserId,
+			"family": info.Family,
+		}).Warnln("refresh token reused, revoking its family")
+		if err := refreshSupport.RevokeRefreshFamily(info.UserId, info.Family); err != nil {
+			return nil, err
+		}
+		return nil, appgo.UnauthorizedErr
+	}
+	return checkInFamily(info.UserId, info.Role, info.Family)
+}
+
+// RevokeRefreshToken revokes token and every token of its family, e.g. on logout
+func RevokeRefreshToken(token RefreshToken) error {
+	if !RefreshEnabled() {
+		return nil
+	}
+	info, _, err := refreshSupport.UseRefreshToken(hashRefreshToken(token))
+	if err != nil || info == nil {
+		return err
+	}
+	return refreshSupport.RevokeRefreshFamily(info.UserId, info.Family)
+}
+
+func newRefreshToken(uid appgo.Id, role appgo.Role,
+	family string) (RefreshToken, time.Time, error) {
+	b, err := crypto.RandBytes(refreshTokenLen)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if family == "" {
+		fb, err := crypto.RandBytes(refreshTokenLen / 2)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		family = hex.EncodeToString(fb)
+	}
+	lifetime := time.Duration(RefreshLifetime()) * time.Second
+	token := RefreshToken(base64.RawURLEncoding.EncodeToString(b))
+	info := &RefreshTokenInfo{
+		UserId:    uid,
+		Role:      role,
+		Family:    family,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	if err := refreshSupport.SaveRefreshToken(hashRefreshToken(token), info); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, info.ExpiresAt, nil
+}
+
+func hashRefreshToken(token RefreshToken) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshLifetime is the lifetime of refresh tokens in seconds, stores of
+// RefreshSupport expire their data with it
+func RefreshLifetime() int {
+	return confOr(appgo.Conf.RefreshToken.Lifetime, defaultRefreshLifetime)
+}
+
+func confOr(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
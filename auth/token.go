@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/redis"
 	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+	"github.com/oxfeeefeee/appgo/toolkit/jwt"
 	"strconv"
 	"strings"
 	"time"
@@ -12,10 +16,37 @@ import (
 
 type Token string
 
+// Tokens handed out by Reissue, keyed by the hash of the stale token
+var reissued = redis.NewStrings("reissued", 0)
+
 func NewToken(userId appgo.Id, role appgo.Role) Token {
-	lifetime := tokenLifetime(role)
-	key := appgo.Conf.RootKey
-	expires := appgo.Id(time.Now().Add(time.Second * time.Duration(lifetime)).UnixNano())
+	return newToken(userId, role, TokenExpiry(role))
+}
+
+func TokenExpiry(role appgo.Role) time.Time {
+	lifetime := TokenLifetime(role)
+	return time.Now().Add(time.Second * time.Duration(lifetime))
+}
+
+// Tokens signed with a key from Conf.RootKeys are prefixed with the key id,
+// i.e. "<keyId>.<base64 data>", tokens without prefix use Conf.RootKey.
+const keyIdSeparator = "."
+
+type TokenClaims struct {
+	UserId  appgo.Id
+	Role    appgo.Role
+	Expires time.Time
+	KeyId   string
+	// Stale is true if the token is signed by a retired key
+	Stale bool
+}
+
+func newToken(userId appgo.Id, role appgo.Role, expiresAt time.Time) Token {
+	if jwtEnabled() {
+		return newJwtToken(userId, role, expiresAt)
+	}
+	keyId, key := activeKey()
+	expires := appgo.Id(expiresAt.UnixNano())
 	parts := []string{userId.Base64(), strconv.Itoa(int(role)), expires.Base64()}
 	data := strings.Join(parts, ",")
 	keybyte, err := crypto.Encrypt([]byte(data), []byte(key))
@@ -24,25 +55,49 @@ func NewToken(userId appgo.Id, role appgo.Role) Token {
 		return Token("")
 	}
 	str := base64.StdEncoding.EncodeToString(keybyte)
+	if keyId != "" {
+		str = keyId + keyIdSeparator + str
+	}
 	return Token(str)
 }
 
 func (t Token) Validate() (appgo.Id, appgo.Role) {
-	byteToken, err := base64.StdEncoding.DecodeString(string(t))
+	c := t.Claims()
+	if c == nil {
+		return 0, 0
+	}
+	return c.UserId, c.Role
+}
+
+// Claims returns nil if the token is invalid or expired, both JWTs and
+// RootKey encrypted tokens are accepted.
+func (t Token) Claims() *TokenClaims {
+	if jwt.IsJwt(string(t)) {
+		return jwtTokenClaims(t)
+	}
+	keyId, data := "", string(t)
+	if i := strings.Index(data, keyIdSeparator); i >= 0 {
+		keyId, data = data[:i], data[i+1:]
+	}
+	key, stale, ok := findKey(keyId)
+	if !ok {
+		log.Infoln("validate token failed: unknown key id ", keyId)
+		return nil
+	}
+	byteToken, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		log.Infoln("validate token failed: ", err)
-		return 0, 0
+		return nil
 	}
-	key := appgo.Conf.RootKey
 	decrypted, err := crypto.Decrypt([]byte(byteToken), []byte(key))
 	if err != nil {
 		log.Infoln("validate token failed: ", err)
-		return 0, 0
+		return nil
 	}
 	subs := strings.Split(string(decrypted), ",")
 	if len(subs) != 3 {
 		log.Errorln("bad token format")
-		return 0, 0
+		return nil
 	}
 	userId := appgo.IdFromBase64(subs[0])
 	roleInt, _ := strconv.Atoi(subs[1])
@@ -50,12 +105,79 @@ func (t Token) Validate() (appgo.Id, appgo.Role) {
 	ttl := expiry.Sub(time.Now())
 	if ttl <= 0 {
 		log.Infoln("validate token failed: expired at ", expiry)
-		return 0, 0
+		return nil
+	}
+	return &TokenClaims{
+		UserId:  userId,
+		Role:    appgo.Role(roleInt),
+		Expires: expiry,
+		KeyId:   keyId,
+		Stale:   stale || jwtEnabled(),
+	}
+}
+
+// Reissue returns a token signed by the active key if t is signed by a
+// retired one or is a legacy token in JWT mode, the new token keeps the
+// expiry of t. It returns t otherwise. A stale token is only reissued
+// once, clients that keep sending it get the same new token back.
+func Reissue(t Token) (Token, error) {
+	c := t.Claims()
+	if c == nil {
+		return "", appgo.UnauthorizedErr
+	}
+	if !c.Stale {
+		return t, nil
+	}
+	sum := sha256.Sum256([]byte(t))
+	key := hex.EncodeToString(sum[:16])
+	if prev, err := reissued.Get(key); err == nil {
+		return Token(prev), nil
+	} else if err != redis.ErrNotFound {
+		return "", err
+	}
+	token := newToken(c.UserId, c.Role, c.Expires)
+	ttl := int(c.Expires.Sub(time.Now())/time.Second) + 1
+	if ok, err := reissued.SetNx(key, ttl, string(token)); err != nil {
+		return "", err
+	} else if !ok {
+		// Reissued by a concurrent request
+		prev, err := reissued.Get(key)
+		return Token(prev), err
+	}
+	banned, _, err := userSystem.CheckIn(c.UserId, c.Role, token)
+	if err == nil && banned {
+		err = appgo.ForbiddenErr
+	}
+	if err != nil {
+		reissued.Del(key)
+		return "", err
+	}
+	return token, nil
+}
+
+// activeKey returns the first key of Conf.RootKeys, or Conf.RootKey with
+// an empty id if the key ring is not configured.
+func activeKey() (string, string) {
+	if keys := appgo.Conf.RootKeys; len(keys) > 0 {
+		return keys[0].Id, keys[0].Key
+	}
+	return "", appgo.Conf.RootKey
+}
+
+func findKey(keyId string) (key string, stale bool, ok bool) {
+	activeId, _ := activeKey()
+	if keyId == "" {
+		return appgo.Conf.RootKey, activeId != "", appgo.Conf.RootKey != ""
+	}
+	for _, k := range appgo.Conf.RootKeys {
+		if k.Id == keyId {
+			return k.Key, k.Id != activeId, true
+		}
 	}
-	return userId, appgo.Role(roleInt)
+	return "", false, false
 }
 
-func tokenLifetime(role appgo.Role) int {
+func TokenLifetime(role appgo.Role) int {
 	switch role {
 	case appgo.RoleAppUser:
 		return appgo.Conf.TokenLifetime.AppUser
@@ -5,6 +5,7 @@ import (
 	"github.com/jinzhu/configor"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -17,7 +18,13 @@ var Conf struct {
 	RootKey      string
 	TemplatePath string
 	CdnDomain    string
-	Pprof        struct {
+	// Ordered key ring, the first key signs new tokens, the others
+	// (and RootKey) are only accepted for validation
+	RootKeys []struct {
+		Id  string
+		Key string
+	}
+	Pprof struct {
 		Enable bool
 		Port   string
 	}
@@ -42,6 +49,48 @@ var Conf struct {
 		Port string
 		GZip bool
 	}
+	// Serve HTTPS on Negroni.Port, file paths are relative to RootDir
+	Tls struct {
+		Enable   bool
+		CertFile string
+		KeyFile  string
+		// "1.0" to "1.3", defaults to "1.2"
+		MinVersion string
+		// "default" or "modern"
+		CipherPolicy string
+		DisableHttp2 bool
+		// Plain HTTP port redirecting to HTTPS, empty to disable
+		RedirectPort string
+		// CAs of client certificates, enables mutual TLS
+		ClientCAFile string
+		// Admin APIs require a client certificate
+		AdminClientCert bool
+	}
+	Shutdown struct {
+		// Seconds to keep serving after a stop signal with readiness failing
+		Delay int
+		// Seconds to wait for in-flight requests and shutdown hooks
+		Timeout int
+	}
+	// How JSON APIs respond errors, handlers can override Mode with the
+	// "errorMode" tag of META
+	Errors struct {
+		// "legacy" (status 200 with errcode and errmsg), "status" (real HTTP
+		// statuses) or "problem" (real statuses with RFC 7807 bodies)
+		Mode string
+		// Requests of older API versions get the legacy response
+		LegacyBelowVersion int
+		// Prefix of problem types, errcodes are appended, "about:blank" if empty
+		ProblemTypeBase string
+	}
+	RateLimit struct {
+		// Client IPs come from X-Forwarded-For or X-Real-IP, only enable
+		// behind a proxy that sets them
+		TrustProxy bool
+		// Number of proxies appending to X-Forwarded-For, the client IP is
+		// the entry added by the outermost one, 1 by default
+		TrustedHops int
+	}
 	Cors struct {
 		AllowedOrigins     string
 		AllowedMethods     string
@@ -54,6 +103,65 @@ var Conf struct {
 		WebUser  int
 		WebAdmin int
 	}
+	Session struct {
+		Enable       bool
+		CacheSeconds int
+	}
+	RefreshToken struct {
+		Enable bool
+		// Seconds, 30 days by default
+		Lifetime int
+	}
+	// Issue JWTs instead of RootKey encrypted tokens, both are accepted
+	Jwt struct {
+		Enable bool
+		// HS256, RS256 or ES256
+		Alg    string
+		Secret string
+		KeyId  string
+		// PEM private key for RS256 and ES256, relative to RootDir
+		PrivateKeyFile string
+		Issuer         string
+	}
+	// KDF of new password hashes, 0 values use crypto.DefaultPasswordParams,
+	// hashes made otherwise are replaced on login
+	Password struct {
+		// argon2id, bcrypt or scrypt
+		Alg           string
+		Argon2Memory  int
+		Argon2Time    int
+		Argon2Threads int
+		BcryptCost    int
+		ScryptLogN    int
+	}
+	// Password login throttling of auth, defaults apply to 0 values
+	Login struct {
+		// Seconds failures are counted in, 3600 by default
+		FailureWindow int
+		// Failures of an account before each attempt is delayed, 3 by default
+		DelayAfter int
+		// Seconds, delays double up to MaxDelay, 30 by default
+		MaxDelay int
+		// Failures of an account that lock it, 10 by default
+		MaxFailures int
+		// Seconds an account stays locked, 900 by default
+		Lockout int
+		// Failures from an IP before its attempts are rejected, 50 by default
+		IpMaxFailures int
+	}
+	// Verification codes of auth mobile flows, defaults apply to 0 values
+	Sms struct {
+		// Digits, 6 by default
+		CodeLen int
+		// Seconds a code is valid, 120 by default
+		CodeTtl int
+		// Seconds before another code can be sent to a mobile, 60 by default
+		Cooldown int
+		// Codes sent to a mobile per day, 10 by default
+		DailyQuota int
+		// Wrong guesses that burn a code, 5 by default
+		MaxAttempts int
+	}
 	Weixin struct {
 		AppId  string
 		Secret string
@@ -70,6 +178,40 @@ var Conf struct {
 	Qq struct {
 		AppId string
 	}
+	// Sign in with Apple
+	Apple struct {
+		// Bundle IDs and service IDs identity tokens can be issued to
+		ClientIds []string
+		// Apple's keys by default
+		JwksUrl          string
+		JwksCacheSeconds int
+		// Rejects identity tokens without a nonce, see apple.AppInfo
+		RequireNonce bool
+	}
+	// OpenID Connect and OAuth2 login providers, see package oidc
+	Oidc []struct {
+		// Identities are keyed by Name, don't rename providers
+		Name         string
+		Issuer       string
+		ClientId     string
+		ClientSecret string
+		RedirectUrl  string
+		Scopes       []string
+		// Override discovery, required without Issuer
+		AuthUrl     string
+		TokenUrl    string
+		UserInfoUrl string
+		JwksUrl     string
+		// Claims of user fields, standard claims by default
+		Claims struct {
+			Subject       string
+			Email         string
+			EmailVerified string
+			Nickname      string
+			Portrait      string
+		}
+		CacheSeconds int
+	}
 	Qiniu struct {
 		AccessKey      string
 		Secret         string
@@ -103,6 +245,26 @@ var Conf struct {
 		Enable bool
 		Port   string
 	}
+	// OpenTelemetry tracing, see package trace
+	Tracing struct {
+		Enable      bool
+		ServiceName string
+		// "otlp" (OTLP over HTTP) or "file" (JSON lines)
+		Exporter string
+		// host:port of the OTLP collector
+		Endpoint string
+		Insecure bool
+		// Relative to RootDir
+		File string
+		// Ratio of new traces to sample, 0 samples all, traces started
+		// upstream follow the caller's decision
+		SampleRatio float64
+	}
+	OpenApi struct {
+		Title       string
+		Version     string
+		Description string
+	}
 }
 
 func initConfig() {
@@ -115,6 +277,14 @@ func initConfig() {
 	if len(Conf.RootKey) != 16 {
 		log.Println("bad root key size")
 	}
+	for _, k := range Conf.RootKeys {
+		if len(k.Key) != 16 {
+			log.Println("bad root key size, key id: ", k.Id)
+		}
+		if k.Id == "" || strings.Contains(k.Id, ".") {
+			log.Panicln("bad root key id: ", k.Id)
+		}
+	}
 }
 
 func searchConfigFile() (fullPath string, rootDir string) {
@@ -0,0 +1,67 @@
+package appgo
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	requestIdContextKey
+	apiVersionContextKey
+	loggerContextKey
+)
+
+type contextUser struct {
+	id   Id
+	role Role
+}
+
+func WithUser(ctx context.Context, id Id, role Role) context.Context {
+	return context.WithValue(ctx, userContextKey, contextUser{id, role})
+}
+
+// UserFromContext returns 0 if the request is not authenticated
+func UserFromContext(ctx context.Context) (Id, Role) {
+	u, _ := ctx.Value(userContextKey).(contextUser)
+	return u.id, u.role
+}
+
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey, id)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdContextKey).(string)
+	return id
+}
+
+func WithApiVersion(ctx context.Context, ver int) context.Context {
+	return context.WithValue(ctx, apiVersionContextKey, ver)
+}
+
+func ApiVersionFromContext(ctx context.Context) int {
+	ver, _ := ctx.Value(apiVersionContextKey).(int)
+	return ver
+}
+
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// LoggerFromContext returns the request scoped logger, or a logger without
+// extra fields if ctx doesn't carry one.
+func LoggerFromContext(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(loggerContextKey).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// ContextPusher is implemented by Pushers whose requests can be traced as
+// part of ctx
+type ContextPusher interface {
+	PushNotifCtx(ctx context.Context, pushInfo map[Id]*PushInfo, content *PushData)
+}
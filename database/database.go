@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/jinzhu/gorm"
@@ -37,6 +38,36 @@ func OpenWithIndex(driver string, index int) (*gorm.DB, error) {
 	}
 }
 
+// BeginTx starts a transaction bound to ctx, database/sql rolls it back and
+// aborts the running query once ctx is done. The returned db only supports
+// the transaction, end it with Commit or Rollback. Its queries are traced.
+func BeginTx(ctx context.Context, db *gorm.DB, opts *sql.TxOptions) (*gorm.DB, error) {
+	tx, err := db.DB().BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	txdb, err := gorm.Open(db.Dialect().GetName(), tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return WithContext(ctx, txdb), nil
+}
+
+// WithTx runs f in a transaction bound to ctx, the transaction is committed
+// if f returns nil and rolled back otherwise.
+func WithTx(ctx context.Context, db *gorm.DB, f func(tx *gorm.DB) error) error {
+	tx, err := BeginTx(ctx, db, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 func SqlStr(str string) sql.NullString {
 	return sql.NullString{str, true}
 }
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"github.com/jinzhu/gorm"
+	"github.com/oxfeeefeee/appgo/trace"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	contextKey = "appgo:context"
+	spanKey    = "appgo:span"
+)
+
+func init() {
+	c := gorm.DefaultCallback
+	c.Create().Before("gorm:create").Register("appgo:trace_before", startSpan("create"))
+	c.Create().After("gorm:create").Register("appgo:trace_after", endSpan)
+	c.Query().Before("gorm:query").Register("appgo:trace_before", startSpan("query"))
+	c.Query().After("gorm:query").Register("appgo:trace_after", endSpan)
+	c.RowQuery().Before("gorm:row_query").Register("appgo:trace_before", startSpan("row_query"))
+	c.RowQuery().After("gorm:row_query").Register("appgo:trace_after", endSpan)
+	c.Update().Before("gorm:update").Register("appgo:trace_before", startSpan("update"))
+	c.Update().After("gorm:update").Register("appgo:trace_after", endSpan)
+	c.Delete().Before("gorm:delete").Register("appgo:trace_before", startSpan("delete"))
+	c.Delete().After("gorm:delete").Register("appgo:trace_after", endSpan)
+}
+
+// WithContext returns db whose queries are traced as child spans of ctx,
+// queries of other dbs are traced as new traces.
+func WithContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.Set(contextKey, ctx)
+}
+
+func startSpan(op string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		ctx := context.Background()
+		if v, ok := scope.Get(contextKey); ok {
+			ctx = v.(context.Context)
+		}
+		_, span := trace.Start(ctx, "gorm "+op, trace.KindClient,
+			attribute.String("db.system", scope.Dialect().GetName()),
+			attribute.String("db.operation", op),
+			attribute.String("db.sql.table", scope.TableName()))
+		scope.InstanceSet(spanKey, span)
+	}
+}
+
+func endSpan(scope *gorm.Scope) {
+	v, ok := scope.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	span.SetAttributes(attribute.String("db.statement", scope.SQL))
+	err := scope.DB().Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	trace.End(span, err)
+}
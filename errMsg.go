@@ -0,0 +1,178 @@
+package appgo
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Language of the registered messages
+	DefaultErrLang = "en"
+
+	// Codes in this range are reserved for appgo
+	reservedErrCodeMin ErrCode = 60000
+	reservedErrCodeMax ErrCode = 69999
+)
+
+var (
+	errMsgLock sync.RWMutex
+	// Registered messages keyed by code
+	errMsgs = make(map[ErrCode]string)
+	// Translations keyed by lower case language tag and code
+	errTranslations = make(map[string]map[ErrCode]string)
+)
+
+var builtinMsgsZh = map[ErrCode]string{
+	ECodeOK:                      "成功",
+	ECodeRedirect:                "重定向",
+	ECodeBadRequest:              "请求错误",
+	ECodeUnauthorized:            "未登录或登录已过期",
+	ECodeForbidden:               "没有权限",
+	ECodeNotFound:                "未找到",
+	ECodePayloadTooLarge:         "上传内容过大",
+	ECodeUnsupportedMediaType:    "不支持的文件类型",
+	ECodeTooManyRequests:         "请求过于频繁，请稍后再试",
+	ECodeInternal:                "服务器内部错误",
+	ECode3rdPartyAuthFailed:      "第三方登录失败",
+	ECodeTimeout:                 "请求超时",
+	ECodeInvalidUsername:         "用户名不合法",
+	ECodeInvalidNickname:         "昵称不合法",
+	ECodeInvalidPassword:         "密码错误",
+	ECodeMobileUserNotFound:      "手机号未注册",
+	ECodeMobileUserBadCode:       "验证码错误",
+	ECodeMobileUserBadToken:      "手机验证已失效",
+	ECodeMobileUserAlreadyExists: "手机号已注册",
+	ECodeSmsCooldown:             "验证码发送过于频繁，请稍后再试",
+	ECodeSmsQuotaExceeded:        "今日验证码发送次数已达上限",
+	ECodeSmsCodeExpired:          "验证码已失效，请重新获取",
+	ECodeAccountLocked:           "登录失败次数过多，账号已暂时锁定",
+	ECodeIdentityTaken:           "该账号已绑定其他用户",
+	ECodeProviderLinked:          "已绑定该平台的其他账号，请先解绑",
+	ECodeLastLoginMethod:         "无法解绑唯一的登录方式",
+}
+
+// RegisterErrCode lets apps define their own codes with a default message
+// in DefaultErrLang, it panics if code is taken or reserved for appgo
+// (60000 to 69999). Codes are mapped to HTTP statuses by ApiError.HttpCode.
+func RegisterErrCode(code ErrCode, msg string) {
+	if code >= reservedErrCodeMin && code <= reservedErrCodeMax {
+		log.Panicln("ErrCode reserved for appgo: ", code)
+	}
+	registerErrCode(code, msg)
+}
+
+func registerErrCode(code ErrCode, msg string) {
+	errMsgLock.Lock()
+	defer errMsgLock.Unlock()
+	if _, ok := errMsgs[code]; ok {
+		log.Panicln("ErrCode already registered: ", code)
+	}
+	errMsgs[code] = msg
+}
+
+// AddErrTranslations adds or replaces messages of lang, e.g. "zh" or "zh-TW"
+func AddErrTranslations(lang string, msgs map[ErrCode]string) {
+	lang = strings.ToLower(lang)
+	errMsgLock.Lock()
+	defer errMsgLock.Unlock()
+	trans, ok := errTranslations[lang]
+	if !ok {
+		trans = make(map[ErrCode]string)
+		errTranslations[lang] = trans
+	}
+	for code, msg := range msgs {
+		trans[code] = msg
+	}
+}
+
+// ErrMsg returns the message of code in lang, or the registered message if
+// there's no translation. It returns false if code is not registered.
+func ErrMsg(code ErrCode, lang string) (string, bool) {
+	if msg, ok := translate(code, strings.ToLower(lang)); ok {
+		return msg, true
+	}
+	errMsgLock.RLock()
+	defer errMsgLock.RUnlock()
+	msg, ok := errMsgs[code]
+	return msg, ok
+}
+
+// Localize returns a copy of e with the message in the most preferred
+// language of an Accept-Language header. Only registered messages are
+// translated, e is returned if its message was customized.
+func (e *ApiError) Localize(acceptLanguage string) *ApiError {
+	if acceptLanguage == "" {
+		return e
+	}
+	if msg, ok := ErrMsg(e.Code, ""); !ok || msg != e.Msg {
+		return e
+	}
+	for _, lang := range parseAcceptLanguage(acceptLanguage) {
+		if baseLang(lang) == DefaultErrLang {
+			return e
+		}
+		if msg, ok := translate(e.Code, lang); ok {
+			ret := *e
+			ret.Msg = msg
+			return &ret
+		}
+	}
+	return e
+}
+
+// translate tries lang, then its base language
+func translate(code ErrCode, lang string) (string, bool) {
+	if lang == "" {
+		return "", false
+	}
+	errMsgLock.RLock()
+	defer errMsgLock.RUnlock()
+	if msg, ok := errTranslations[lang][code]; ok {
+		return msg, true
+	}
+	msg, ok := errTranslations[baseLang(lang)][code]
+	return msg, ok
+}
+
+func baseLang(lang string) string {
+	return strings.SplitN(lang, "-", 2)[0]
+}
+
+// parseAcceptLanguage returns lower case language tags by preference
+func parseAcceptLanguage(header string) []string {
+	type langQ struct {
+		lang string
+		q    float64
+	}
+	var langs []langQ
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, langQ{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	ret := make([]string, len(langs))
+	for i, l := range langs {
+		ret[i] = l.lang
+	}
+	return ret
+}
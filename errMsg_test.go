@@ -0,0 +1,52 @@
+package appgo
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	cases := []struct {
+		header string
+		langs  []string
+	}{
+		{"", []string{}},
+		{"zh-CN", []string{"zh-cn"}},
+		{"zh-TW;q=0.8, en;q=0.9, fr", []string{"fr", "en", "zh-tw"}},
+		// Equal q-values keep their order
+		{"de, ja;q=0.5, ko;q=0.5", []string{"de", "ja", "ko"}},
+		{"*;q=0.5, de;q=0, en; q=0.1", []string{"en"}},
+		{"en;q=bad", []string{"en"}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.langs, parseAcceptLanguage(c.header), c.header)
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	const code ErrCode = 12001
+	RegisterErrCode(code, "Custom")
+	AddErrTranslations("zh", map[ErrCode]string{code: "自定义"})
+	AddErrTranslations("zh-TW", map[ErrCode]string{code: "自訂"})
+	err := NewApiErrWithCode(code)
+	cases := []struct {
+		acceptLanguage string
+		msg            string
+	}{
+		{"", "Custom"},
+		{"zh-TW", "自訂"},
+		// Falls back to the base language
+		{"zh-CN", "自定义"},
+		{"fr, zh;q=0.5", "自定义"},
+		{"en-US, zh", "Custom"},
+		{"fr", "Custom"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.msg, err.Localize(c.acceptLanguage).Msg, c.acceptLanguage)
+	}
+	assert.Equal(t, "未找到", NotFoundErr.Localize("zh-HK").Msg)
+	// Customized messages stay as they are
+	assert.Equal(t, "no such post",
+		NewApiErr(ECodeNotFound, "no such post").Localize("zh").Msg)
+	assert.Equal(t, "Custom", err.Msg)
+}
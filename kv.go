@@ -0,0 +1,30 @@
+package appgo
+
+import (
+	"strconv"
+)
+
+// KvIncr uses the counter of store if it's a KvCounter, otherwise it's
+// emulated with Get and Set, which is racy and restarts the timeout, so
+// KvStores without counters are deprecated.
+func KvIncr(store KvStore, k string, timeout int) (int64, error) {
+	if c, ok := store.(KvCounter); ok {
+		return c.Incr(k, timeout)
+	}
+	v, err := store.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := strconv.ParseInt(v, 10, 64)
+	n++
+	return n, store.Set(k, strconv.FormatInt(n, 10), timeout)
+}
+
+// KvDel deletes k if store is a KvCounter, otherwise it's set to "", which
+// Get returns for missing keys too.
+func KvDel(store KvStore, k string) error {
+	if c, ok := store.(KvCounter); ok {
+		return c.Del(k)
+	}
+	return store.Set(k, "", 1)
+}
@@ -0,0 +1,136 @@
+// Package ratelimit limits the rate of actions across all instances with a
+// token bucket kept in redis.
+package ratelimit
+
+import (
+	"errors"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/redis"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"strings"
+	"time"
+)
+
+const keyPrefix = "rl:"
+
+var ErrBadLimit = errors.New("ratelimit: bad limit")
+
+// GCRA, the "theoretical arrival time" of the next request is stored, which
+// is a token bucket that doesn't need a timer to refill.
+// Returns {allowed, milliseconds to wait, remaining}.
+var gcraScript = redis.NewScript(1, `
+local emission = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local newTat = tat + emission
+local allowAt = newTat - emission * burst
+if allowAt > now then
+	return {0, math.ceil(allowAt - now), 0}
+end
+redis.call('SET', KEYS[1], tostring(newTat), 'PX', math.ceil(newTat - now))
+return {1, 0, math.floor((now - allowAt) / emission)}
+`)
+
+// Limit allows Count actions per Period, all of them can be taken at once
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// How long to wait before the next action is allowed
+	RetryAfter time.Duration
+}
+
+type Limiter struct {
+	name  string
+	limit Limit
+}
+
+var units = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+}
+
+// ParseLimit parses "<count>/<period>", where period is s, m, h, d or a
+// duration like 10m, e.g. "5/m" or "100/12h".
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, ErrBadLimit
+	}
+	count := strutil.ToInt(parts[0])
+	period, ok := units[parts[1]]
+	if !ok {
+		var err error
+		if period, err = time.ParseDuration(parts[1]); err != nil {
+			return Limit{}, ErrBadLimit
+		}
+	}
+	if count <= 0 || period <= 0 {
+		return Limit{}, ErrBadLimit
+	}
+	return Limit{count, period}, nil
+}
+
+// New returns a limiter, its buckets are shared by limiters of the same name
+func New(name string, limit Limit) *Limiter {
+	return &Limiter{name, limit}
+}
+
+func (l *Limiter) Limit() Limit {
+	return l.limit
+}
+
+// Allow takes a token from the bucket of key
+func (l *Limiter) Allow(key string) (*Result, error) {
+	return l.allow(key, time.Now())
+}
+
+func (l *Limiter) allow(key string, now time.Time) (*Result, error) {
+	emission := float64(l.limit.Period/time.Millisecond) / float64(l.limit.Count)
+	vals, err := redigo.Int64s(gcraScript.Do(keyPrefix+l.name+":"+key,
+		emission, l.limit.Count, now.UnixNano()/int64(time.Millisecond)))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) != 3 {
+		return nil, errors.New("ratelimit: bad script reply")
+	}
+	return &Result{
+		Allowed:    vals[0] == 1,
+		Remaining:  int(vals[2]),
+		RetryAfter: time.Duration(vals[1]) * time.Millisecond,
+	}, nil
+}
+
+// Check is Allow returning appgo.TooManyRequestsErr with a retry hint if the
+// action isn't allowed. Redis errors are returned as they are.
+func (l *Limiter) Check(key string) error {
+	ret, err := l.Allow(key)
+	if err != nil {
+		return err
+	}
+	if !ret.Allowed {
+		return TooManyRequests(ret.RetryAfter)
+	}
+	return nil
+}
+
+// TooManyRequests returns appgo.TooManyRequestsErr telling clients to
+// retry after wait, rounded up to seconds. The seconds are also in the
+// body for clients that can't read headers.
+func TooManyRequests(wait time.Duration) *appgo.ApiError {
+	secs := int((wait + time.Second - 1) / time.Second)
+	return appgo.TooManyRequestsErr.WithRetryAfter(secs).
+		WithData(map[string]int{"retryAfter": secs})
+}
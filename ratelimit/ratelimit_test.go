@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// The port of conf/appgo.yml
+const testRedisAddr = "127.0.0.1:16391"
+
+func TestMain(m *testing.M) {
+	mr := miniredis.NewMiniRedis()
+	if err := mr.StartAddr(testRedisAddr); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	mr.Close()
+	os.Exit(code)
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		s     string
+		limit Limit
+		err   error
+	}{
+		{"5/m", Limit{5, time.Minute}, nil},
+		{" 100/12h ", Limit{100, 12 * time.Hour}, nil},
+		{"1/s", Limit{1, time.Second}, nil},
+		{"3/d", Limit{3, 24 * time.Hour}, nil},
+		{"10/500ms", Limit{10, 500 * time.Millisecond}, nil},
+		{"", Limit{}, ErrBadLimit},
+		{"5", Limit{}, ErrBadLimit},
+		{"5/", Limit{}, ErrBadLimit},
+		{"5/w", Limit{}, ErrBadLimit},
+		{"0/m", Limit{}, ErrBadLimit},
+		{"-1/m", Limit{}, ErrBadLimit},
+		{"x/m", Limit{}, ErrBadLimit},
+		{"5/-1m", Limit{}, ErrBadLimit},
+	}
+	for _, c := range cases {
+		limit, err := ParseLimit(c.s)
+		assert.Equal(t, c.err, err, c.s)
+		assert.Equal(t, c.limit, limit, c.s)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	// A token every 200ms, 5 at once
+	l := New("test", Limit{5, time.Second})
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) *Result {
+		ret, err := l.allow("k", now.Add(d))
+		assert.Nil(t, err)
+		return ret
+	}
+	for i := 4; i >= 0; i-- {
+		assert.Equal(t, &Result{true, i, 0}, at(0))
+	}
+	assert.Equal(t, &Result{false, 0, 200 * time.Millisecond}, at(0))
+	assert.Equal(t, &Result{false, 0, 50 * time.Millisecond}, at(150*time.Millisecond))
+	assert.Equal(t, &Result{true, 0, 0}, at(200*time.Millisecond))
+	// Refills by a token per emission interval, up to the burst
+	assert.Equal(t, &Result{true, 1, 0}, at(600*time.Millisecond))
+	assert.Equal(t, &Result{true, 4, 0}, at(time.Hour))
+	// Buckets are per key
+	ret, err := l.allow("other", now)
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{true, 4, 0}, ret)
+}
@@ -0,0 +1,82 @@
+package realtime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"sync"
+)
+
+// Messages are dropped if a client falls this far behind
+const sendBufferSize = 64
+
+// Client is a connection of a user, messages to it are queued until
+// written to the socket
+type Client struct {
+	Id     string
+	UserId appgo.Id
+	Role   appgo.Role
+	send   chan []byte
+	// Guarded by the lock of the hub
+	rooms  map[string]bool
+	lock   sync.Mutex
+	closed bool
+}
+
+func newClient(id appgo.Id, role appgo.Role) *Client {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Client{
+		Id:     hex.EncodeToString(b),
+		UserId: id,
+		Role:   role,
+		send:   make(chan []byte, sendBufferSize),
+		rooms:  make(map[string]bool),
+	}
+}
+
+// Send delivers a message to this client only
+func (c *Client) Send(typ string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&Message{Type: typ, Data: raw})
+	if err != nil {
+		return err
+	}
+	c.enqueue(payload)
+	return nil
+}
+
+// Outbox is closed when the client is unregistered
+func (c *Client) Outbox() <-chan []byte {
+	return c.send
+}
+
+func (c *Client) enqueue(data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		log.WithFields(log.Fields{
+			"user":   c.UserId,
+			"client": c.Id,
+		}).Warnln("websocket client too slow, message dropped")
+	}
+}
+
+func (c *Client) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
@@ -0,0 +1,237 @@
+// Package realtime keeps track of websocket clients of this instance and
+// fans messages out to clients of all instances via redis pub/sub.
+package realtime
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/redis"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userChannelPrefix = "rt:u:"
+	roomChannelPrefix = "rt:r:"
+	presenceNamespace = "rt:online"
+
+	// Clients have to refresh their presence within this many seconds
+	PresenceTTL = 90
+
+	MessageTypePush  = "push"
+	MessageTypeJoin  = "join"
+	MessageTypeLeave = "leave"
+	MessageTypeError = "error"
+)
+
+var (
+	hub     *Hub
+	hubOnce sync.Once
+)
+
+type Message struct {
+	Type string          `json:"type"`
+	Room string          `json:"room,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type Hub struct {
+	lock     sync.RWMutex
+	users    map[appgo.Id]map[*Client]bool
+	rooms    map[string]map[*Client]bool
+	sub      *redis.Subscriber
+	presence *redis.Hashes
+}
+
+// DefaultHub returns the hub of this instance, it's created on first use
+func DefaultHub() *Hub {
+	hubOnce.Do(func() {
+		hub = &Hub{
+			users:    make(map[appgo.Id]map[*Client]bool),
+			rooms:    make(map[string]map[*Client]bool),
+			presence: redis.NewHashes(presenceNamespace, PresenceTTL),
+		}
+		hub.sub = redis.NewSubscriber(hub.dispatch)
+	})
+	return hub
+}
+
+// SendToUser delivers a message to all clients of id, on any instance
+func SendToUser(id appgo.Id, typ string, data interface{}) error {
+	return publish(userChannel(id), &Message{Type: typ}, data)
+}
+
+// SendToRoom delivers a message to all clients in room, on any instance
+func SendToRoom(room, typ string, data interface{}) error {
+	return publish(roomChannel(room), &Message{Type: typ, Room: room}, data)
+}
+
+// Online returns which of ids have a live client on any instance
+func Online(ids []appgo.Id) (map[appgo.Id]bool, error) {
+	presence := DefaultHub().presence
+	deadline := time.Now().Unix() - PresenceTTL
+	ret := make(map[appgo.Id]bool)
+	for _, id := range ids {
+		clients, err := presence.GetAll(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, seen := range clients {
+			if ts, _ := strconv.ParseInt(seen, 10, 64); ts > deadline {
+				ret[id] = true
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (h *Hub) Register(id appgo.Id, role appgo.Role) *Client {
+	c := newClient(id, role)
+	h.lock.Lock()
+	clients, ok := h.users[id]
+	if !ok {
+		clients = make(map[*Client]bool)
+		h.users[id] = clients
+	}
+	clients[c] = true
+	// Subscriptions change under the lock, or they could race with
+	// the last client of the channel leaving
+	if !ok {
+		h.subscribe(userChannel(id))
+	}
+	h.lock.Unlock()
+	h.Touch(c)
+	return c
+}
+
+func (h *Hub) Unregister(c *Client) {
+	h.lock.Lock()
+	var channels []string
+	for room := range c.rooms {
+		if h.leave(c, room) {
+			channels = append(channels, roomChannel(room))
+		}
+	}
+	if clients := h.users[c.UserId]; clients != nil {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(h.users, c.UserId)
+			channels = append(channels, userChannel(c.UserId))
+		}
+	}
+	h.unsubscribe(channels...)
+	h.lock.Unlock()
+	if err := h.presence.Del(c.UserId, c.Id); err != nil {
+		log.WithField("error", err).Errorln("failed to remove presence")
+	}
+	c.close()
+}
+
+func (h *Hub) Join(c *Client, room string) {
+	h.lock.Lock()
+	clients, ok := h.rooms[room]
+	if !ok {
+		clients = make(map[*Client]bool)
+		h.rooms[room] = clients
+	}
+	clients[c] = true
+	c.rooms[room] = true
+	if !ok {
+		h.subscribe(roomChannel(room))
+	}
+	h.lock.Unlock()
+}
+
+func (h *Hub) Leave(c *Client, room string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.leave(c, room) {
+		h.unsubscribe(roomChannel(room))
+	}
+}
+
+// Touch refreshes the presence of c, call it on client heartbeats
+func (h *Hub) Touch(c *Client) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := h.presence.Set(c.UserId, c.Id, now); err != nil {
+		log.WithField("error", err).Errorln("failed to refresh presence")
+	}
+}
+
+// leave returns true if c was the last client of room, h.lock must be held
+func (h *Hub) leave(c *Client, room string) bool {
+	delete(c.rooms, room)
+	clients := h.rooms[room]
+	if clients == nil {
+		return false
+	}
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(h.rooms, room)
+		return true
+	}
+	return false
+}
+
+// subscribe and unsubscribe are called with h.lock held
+func (h *Hub) subscribe(channel string) {
+	if err := h.sub.Subscribe(channel); err != nil {
+		log.WithFields(log.Fields{
+			"channel": channel,
+			"error":   err,
+		}).Errorln("failed to subscribe")
+	}
+}
+
+func (h *Hub) unsubscribe(channels ...string) {
+	if len(channels) == 0 {
+		return
+	}
+	if err := h.sub.Unsubscribe(channels...); err != nil {
+		log.WithField("error", err).Errorln("failed to unsubscribe")
+	}
+}
+
+func (h *Hub) dispatch(channel string, data []byte) {
+	h.lock.RLock()
+	var clients map[*Client]bool
+	if strings.HasPrefix(channel, userChannelPrefix) {
+		id := appgo.IdFromStr(strings.TrimPrefix(channel, userChannelPrefix))
+		clients = h.users[id]
+	} else if strings.HasPrefix(channel, roomChannelPrefix) {
+		clients = h.rooms[strings.TrimPrefix(channel, roomChannelPrefix)]
+	}
+	targets := make([]*Client, 0, len(clients))
+	for c := range clients {
+		targets = append(targets, c)
+	}
+	h.lock.RUnlock()
+	for _, c := range targets {
+		c.enqueue(data)
+	}
+}
+
+func publish(channel string, msg *Message, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg.Data = raw
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return redis.Publish(channel, payload)
+}
+
+func userChannel(id appgo.Id) string {
+	return userChannelPrefix + id.String()
+}
+
+func roomChannel(room string) string {
+	return roomChannelPrefix + room
+}
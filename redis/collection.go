@@ -43,10 +43,25 @@ func (c *collection) setEx(key interface{}, expire int, val interface{}) error {
 	return nil
 }
 
+func (c *collection) setNx(key interface{}, expire int, val interface{}) (bool, error) {
+	reply, err := Do("SET", c.ckey(key), val, "EX", expire, "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
 func (c *collection) get(key interface{}) (interface{}, error) {
 	return Do("GET", c.ckey(key))
 }
 
+func (c *collection) del(key interface{}) error {
+	if _, err := Do("DEL", c.ckey(key)); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (c *collection) ckey(k interface{}) string {
 	return fmt.Sprintf("%s:%v", c.namespace, k)
 }
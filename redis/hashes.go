@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"fmt"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+type Hashes struct {
+	namespace string
+	expire    int
+}
+
+// expire is applied to the whole hash on every write, 0 means never expire
+func NewHashes(namespace string, expire int) *Hashes {
+	return &Hashes{"hs:" + namespace, expire}
+}
+
+func (h *Hashes) Set(key, field interface{}, val string) error {
+	if h.expire > 0 {
+		trans := BeginTrans()
+		trans.Send("HSET", h.keystr(key), field, val)
+		trans.Send("EXPIRE", h.keystr(key), h.expire)
+		_, err := trans.Exec()
+		return err
+	}
+	if _, err := Do("HSET", h.keystr(key), field, val); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *Hashes) Get(key, field interface{}) (string, error) {
+	val, err := Do("HGET", h.keystr(key), field)
+	if err != nil {
+		return "", err
+	} else if val == nil {
+		return "", ErrNotFound
+	}
+	return redigo.String(val, nil)
+}
+
+func (h *Hashes) GetAll(key interface{}) (map[string]string, error) {
+	return redigo.StringMap(Do("HGETALL", h.keystr(key)))
+}
+
+func (h *Hashes) Del(key interface{}, fields ...interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	args := append([]interface{}{h.keystr(key)}, fields...)
+	if _, err := Do("HDEL", args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *Hashes) Clear(key interface{}) error {
+	if _, err := Do("DEL", h.keystr(key)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *Hashes) keystr(k interface{}) string {
+	return fmt.Sprintf("%s:%v", h.namespace, k)
+}
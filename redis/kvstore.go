@@ -0,0 +1,51 @@
+package redis
+
+import (
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+var incrScript = NewScript(1, `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// KvStore implements appgo.KvStore and appgo.KvCounter, missing keys are
+// read as "".
+type KvStore struct {
+	prefix string
+}
+
+func NewKvStore(prefix string) *KvStore {
+	return &KvStore{prefix}
+}
+
+// Set never expires k if timeout is 0
+func (s *KvStore) Set(k, v string, timeout int) error {
+	var err error
+	if timeout > 0 {
+		_, err = Do("SET", s.prefix+k, v, "EX", timeout)
+	} else {
+		_, err = Do("SET", s.prefix+k, v)
+	}
+	return err
+}
+
+func (s *KvStore) Get(k string) (string, error) {
+	v, err := redigo.String(Do("GET", s.prefix+k))
+	if err == redigo.ErrNil {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *KvStore) Incr(k string, timeout int) (int64, error) {
+	return redigo.Int64(incrScript.Do(s.prefix+k, timeout))
+}
+
+func (s *KvStore) Del(k string) error {
+	_, err := Do("DEL", s.prefix+k)
+	return err
+}
@@ -0,0 +1,133 @@
+package redis
+
+import (
+	log "github.com/Sirupsen/logrus"
+	redigo "github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+const resubscribeDelay = time.Second
+
+func Publish(channel string, msg []byte) error {
+	_, err := Do("PUBLISH", channel, msg)
+	return err
+}
+
+// Subscriber receives messages of the channels it subscribes to on a
+// dedicated connection, it reconnects and resubscribes on errors.
+type Subscriber struct {
+	onMessage func(channel string, data []byte)
+	lock      sync.Mutex
+	conn      *redigo.PubSubConn
+	channels  map[string]bool
+	closed    bool
+}
+
+// NewSubscriber calls onMessage from a single goroutine, one message at a time
+func NewSubscriber(onMessage func(channel string, data []byte)) *Subscriber {
+	s := &Subscriber{
+		onMessage: onMessage,
+		channels:  make(map[string]bool),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Subscriber) Subscribe(channels ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var args []interface{}
+	for _, c := range channels {
+		if !s.channels[c] {
+			s.channels[c] = true
+			args = append(args, c)
+		}
+	}
+	if s.conn == nil || len(args) == 0 {
+		return nil
+	}
+	return s.conn.Subscribe(args...)
+}
+
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var args []interface{}
+	for _, c := range channels {
+		if s.channels[c] {
+			delete(s.channels, c)
+			args = append(args, c)
+		}
+	}
+	if s.conn == nil || len(args) == 0 {
+		return nil
+	}
+	return s.conn.Unsubscribe(args...)
+}
+
+func (s *Subscriber) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func (s *Subscriber) run() {
+	for {
+		conn, ok := s.connect()
+		if !ok {
+			return
+		}
+		s.receive(conn)
+		s.lock.Lock()
+		s.conn = nil
+		closed := s.closed
+		s.lock.Unlock()
+		conn.Close()
+		if closed {
+			return
+		}
+		time.Sleep(resubscribeDelay)
+	}
+}
+
+func (s *Subscriber) connect() (*redigo.PubSubConn, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	conn := &redigo.PubSubConn{Conn: pool.Get()}
+	var args []interface{}
+	for c := range s.channels {
+		args = append(args, c)
+	}
+	if len(args) > 0 {
+		if err := conn.Subscribe(args...); err != nil {
+			log.WithField("error", err).Errorln("failed to resubscribe")
+		}
+	}
+	s.conn = conn
+	return conn, true
+}
+
+func (s *Subscriber) receive(conn *redigo.PubSubConn) {
+	for {
+		switch v := conn.Receive().(type) {
+		case redigo.Message:
+			s.onMessage(v.Channel, v.Data)
+		case error:
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if !closed {
+				log.WithField("error", v).Errorln("redis subscription failed")
+			}
+			return
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package redis
 
 import (
+	"context"
 	"fmt"
 	redigo "github.com/garyburd/redigo/redis"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/trace"
+	"go.opentelemetry.io/otel/attribute"
 	"time"
 )
 
@@ -38,11 +41,37 @@ func init() {
 }
 
 func Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	return DoCtx(context.Background(), cmd, args...)
+}
+
+// DoCtx is Do bounded by the deadline of ctx, redis commands can't be
+// interrupted, so cancellation is only checked before sending cmd.
+// The command is traced as a child span of ctx.
+func DoCtx(ctx context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, span := trace.Start(ctx, "redis "+cmd, trace.KindClient,
+		attribute.String("db.system", "redis"),
+		attribute.String("db.operation", cmd))
+	defer func() { trace.End(span, err) }()
 	conn := pool.Get()
 	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := deadline.Sub(time.Now())
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		return redigo.DoWithTimeout(conn, timeout, cmd, args...)
+	}
 	return conn.Do(cmd, args...)
 }
 
+// Close closes the connection pool, e.g. in a server shutdown hook
+func Close() error {
+	return pool.Close()
+}
+
 func BeginTrans() *Trans {
 	conn := pool.Get()
 	conn.Send("MULTI")
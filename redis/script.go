@@ -0,0 +1,20 @@
+package redis
+
+import (
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// Script is a Lua script run by EVALSHA, it's loaded on first use
+type Script struct {
+	script *redigo.Script
+}
+
+func NewScript(keyCount int, src string) *Script {
+	return &Script{redigo.NewScript(keyCount, src)}
+}
+
+func (s *Script) Do(keysAndArgs ...interface{}) (reply interface{}, err error) {
+	conn := pool.Get()
+	defer conn.Close()
+	return s.script.Do(conn, keysAndArgs...)
+}
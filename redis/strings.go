@@ -34,3 +34,28 @@ func (s *Strings) Get(key interface{}) (string, error) {
 	}
 	return redigo.String(val, nil)
 }
+
+func (s *Strings) Del(key interface{}) error {
+	return s.col.del(key)
+}
+
+// SetNx sets key only if it does not exist yet, it reports whether key was set
+func (s *Strings) SetNx(key interface{}, expire int, val string) (bool, error) {
+	return s.col.setNx(key, expire, val)
+}
+
+// Take gets and deletes key, only one of concurrent callers gets the value
+func (s *Strings) Take(key interface{}) (string, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return "", err
+	}
+	n, err := redigo.Int(Do("DEL", s.col.ckey(key)))
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", ErrNotFound
+	}
+	return val, nil
+}
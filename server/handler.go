@@ -1,20 +1,24 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	log "github.com/Sirupsen/logrus"
-	gkmetrics "github.com/go-kit/kit/metrics"
-	gkprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/oxfeeefeee/appgo"
 	"github.com/oxfeeefeee/appgo/auth"
 	"github.com/oxfeeefeee/appgo/toolkit/strutil"
-	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/oxfeeefeee/appgo/toolkit/validate"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/unrolled/render"
+	"go.opentelemetry.io/otel/attribute"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 	"time"
@@ -27,6 +31,8 @@ const (
 	ContentFieldName     = "Content__"
 	RequestFieldName     = "Request__"
 	ConfVerFieldName     = "ConfVer__"
+	FilesFieldName       = "Files__"
+	UploadsFieldName     = "Uploads__"
 
 	maxVersion = 99
 )
@@ -39,10 +45,6 @@ const (
 
 var decoder = schema.NewDecoder()
 
-var metrics_req_dur gkmetrics.Histogram
-
-var metrics_query_count map[string]gkmetrics.Counter
-
 type HandlerType int
 
 type httpFunc struct {
@@ -52,54 +54,60 @@ type httpFunc struct {
 	hasContent     bool
 	hasRequest     bool
 	hasConfVer     bool
+	hasContext     bool
 	dummyInput     bool
 	allowAnonymous bool
 	inputType      reflect.Type
 	contentType    reflect.Type
 	funcValue      reflect.Value
+	inputChecker   *validate.Validator
+	contentChecker *validate.Validator
+	permissions    []string
+	upload         *uploadSpec
+	stream         bool
 }
 
 type handler struct {
 	htype    HandlerType
+	name     string
 	path     string
+	summary  string
 	template string
-	funcs    map[string]*httpFunc
-	supports []string
-	ts       TokenStore
-	renderer *render.Render
+	timeout  time.Duration
+	// Interval of keep-alive messages of streaming responses
+	heartbeat time.Duration
+	errorMode ErrorMode
+	// Apply to all funcs
+	rateLimits []*rateLimitSpec
+	funcs      map[string]*httpFunc
+	supports   []string
+	ts         TokenStore
+	life       *lifecycle
+	renderer   *render.Render
 }
 
 func init() {
 	decoder.IgnoreUnknownKeys(true)
-
-	if appgo.Conf.Prometheus.Enable {
-		metrics_req_dur = gkprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
-			Namespace: "appgo",
-			Subsystem: "http",
-			Name:      "request_duration_microseconds",
-			Help:      "Total time spent serving requests.",
-		}, []string{})
-		metrics_query_count = map[string]gkmetrics.Counter{
-			"all": gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
-				Namespace: "appgo",
-				Subsystem: "http",
-				Name:      "request_counter",
-				Help:      "Total served requests count.",
-			}, []string{})}
-	}
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer addMetrics(r, time.Now())
-
 	method := r.Method
 	ver := apiVersionFromHeader(r)
+	ctx, span := trace.Start(r.Context(), h.name+" "+method, trace.KindInternal,
+		attribute.Int("appgo.api_version", ver))
+	defer span.End()
+	r = r.WithContext(ctx)
+	if prom != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		defer prom.observe(r, sw, ver)()
+		w = sw
+	}
 	if ver > 1 && ver <= maxVersion {
 		method += strutil.FromInt(ver)
 	}
 	f, ok := h.funcs[method]
 	if !ok {
-		h.renderError(w, appgo.NewApiErr(
+		h.renderError(w, r, appgo.NewApiErr(
 			appgo.ECodeNotFound,
 			"Bad API version"))
 		return
@@ -109,20 +117,22 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		input = reflect.ValueOf((*appgo.DummyInput)(nil))
 	} else {
 		input = reflect.New(f.inputType)
-		if err := decoder.Decode(input.Interface(), r.URL.Query()); err != nil {
-			h.renderError(w, appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
+		if err := decoder.Decode(input.Interface(), formValues(r.URL.Query())); err != nil {
+			h.renderError(w, r, appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
 			return
 		}
 	}
+	var user appgo.Id
+	var role appgo.Role
 	if f.requireAuth {
-		user, _ := h.authByHeader(r)
+		user, role = h.authByHeader(w, r)
 		s := input.Elem()
 		field := s.FieldByName(UserIdFieldName)
 		if user == 0 {
 			if f.allowAnonymous {
 				field.SetInt(appgo.AnonymousId)
 			} else {
-				h.renderError(w, appgo.NewApiErr(
+				h.renderError(w, r, appgo.NewApiErr(
 					appgo.ECodeUnauthorized,
 					"either remove UserId__ in your input define, or add allowAnonymous tag",
 				))
@@ -132,22 +142,34 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			field.SetInt(int64(user))
 		}
 	} else if f.requireAdmin {
-		user, role := h.authByHeader(r)
+		user, role = h.authByHeader(w, r)
 		s := input.Elem()
 		f := s.FieldByName(AdminUserIdFieldName)
 		if user == 0 || role != appgo.RoleWebAdmin {
-			h.renderError(w, appgo.NewApiErr(
+			h.renderError(w, r, appgo.NewApiErr(
 				appgo.ECodeUnauthorized,
 				"admin role required, you could remove AdminUserId__ in your input define"))
 			return
 		}
+		if appgo.Conf.Tls.AdminClientCert && !ClientCertVerified(r) {
+			h.renderError(w, r, appgo.NewApiErr(
+				appgo.ECodeForbidden,
+				"client certificate required"))
+			return
+		}
 		f.SetInt(int64(user))
 	}
+	if len(f.permissions) > 0 {
+		if aerr := h.checkPermissions(user, f.permissions); aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+	}
 	if f.hasResId {
 		vars := mux.Vars(r)
 		id := appgo.IdFromStr(vars["id"])
 		if id == 0 {
-			h.renderError(w, appgo.NewApiErr(
+			h.renderError(w, r, appgo.NewApiErr(
 				appgo.ECodeNotFound,
 				"ResourceId ('{id}' in url) required, you could remove ResourceId__ in your input define"))
 			return
@@ -159,17 +181,54 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if f.hasContent {
 		content := reflect.New(f.contentType.Elem())
 		if err := json.NewDecoder(r.Body).Decode(content.Interface()); err != nil {
-			h.renderError(w, appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
+			h.renderError(w, r, appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
 			return
 		}
 		s := input.Elem()
 		f := s.FieldByName(ContentFieldName)
 		f.Set(content)
 	}
+	// Files stored to qiniu are deleted again unless the API func succeeds
+	var uploads []*UploadedFile
+	succeeded := false
+	defer func() {
+		if !succeeded && len(uploads) > 0 {
+			deleteUploads(uploads)
+		}
+	}()
+	if f.upload != nil {
+		// The form values are checked before any file is stored
+		check := func(values url.Values) *appgo.ApiError {
+			if err := decoder.Decode(input.Interface(), formValues(values)); err != nil {
+				return appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+			}
+			return h.checkInput(w, r, f, input, user)
+		}
+		files, stored, aerr := f.upload.parse(w, r, check)
+		if r.MultipartForm != nil {
+			defer r.MultipartForm.RemoveAll()
+		}
+		if aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+		uploads = stored
+		s := input.Elem()
+		if f.upload.stream {
+			s.FieldByName(UploadsFieldName).Set(reflect.ValueOf(uploads))
+		} else {
+			s.FieldByName(FilesFieldName).Set(reflect.ValueOf(files))
+		}
+	} else if aerr := h.checkInput(w, r, f, input, user); aerr != nil {
+		h.renderError(w, r, aerr)
+		return
+	}
+	ctx, cancel := h.newContext(w, r, user, role, ver)
+	defer cancel()
 	if f.hasRequest {
 		s := input.Elem()
 		f := s.FieldByName(RequestFieldName)
-		f.Set(reflect.ValueOf(r))
+		f.Set(reflect.ValueOf(r.WithContext(ctx)))
 	}
 	if f.hasConfVer {
 		ver := confVersionFromHeader(r)
@@ -178,17 +237,33 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		f.Set(reflect.ValueOf(ver))
 	}
 	argsIn := []reflect.Value{input}
+	if f.hasContext {
+		argsIn = []reflect.Value{reflect.ValueOf(ctx), input}
+	}
 	returns := f.funcValue.Call(argsIn)
 	rl := len(returns)
 	if !(rl == 1 || rl == 2 || (rl == 3 && h.htype == HandlerTypeHtml)) {
-		h.renderError(w, appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format"))
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format"))
 		return
 	}
 	// returns (reply, template-name, error) or (reply, error) or returns (error)
 	retErr := returns[rl-1]
+	// Errors caused by the deadline or the client going away are not
+	// interesting, report the cause instead.
+	if !retErr.IsNil() && ctx.Err() != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			h.renderError(w, r, appgo.TimeoutErr)
+		} else {
+			appgo.LoggerFromContext(ctx).Infoln("client gone: ", retErr.Interface())
+		}
+		return
+	}
 	// First check if err is nil
 	if retErr.IsNil() {
-		if rl == 3 {
+		succeeded = true
+		if f.stream {
+			h.renderStream(ctx, w, r, returns[0])
+		} else if rl == 3 {
 			template := returns[1].Interface().(string)
 			h.renderHtml(w, template, returns[0].Interface())
 		} else if rl == 2 {
@@ -204,46 +279,110 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				http.Redirect(w, r, aerr.Msg, http.StatusFound)
 				return
 			}
-			h.renderError(w, aerr)
+			h.renderError(w, r, aerr)
 		}
 	}
 }
 
-func addMetrics(r *http.Request, begin time.Time) {
-	if !appgo.Conf.Prometheus.Enable {
-		return
+func (h *handler) authByHeader(w http.ResponseWriter, r *http.Request) (appgo.Id, appgo.Role) {
+	token := auth.Token(r.Header.Get(appgo.CustomTokenHeaderName))
+	claims := token.Claims()
+	if claims == nil {
+		return 0, 0
+	}
+	if !h.ts.Validate(token) {
+		return 0, 0
+	}
+	// Hand out a token signed by the active key, clients are expected to
+	// replace their token with the one in the response header.
+	if claims.Stale {
+		if newToken, err := auth.Reissue(token); err != nil {
+			log.WithFields(log.Fields{
+				"user":  claims.UserId,
+				"error": err,
+			}).Errorln("failed to reissue token")
+		} else {
+			w.Header().Set(appgo.CustomTokenHeaderName, string(newToken))
+		}
 	}
-	metrics_req_dur.Observe(float64(time.Since(begin) / time.Microsecond))
+	return claims.UserId, claims.Role
+}
 
-	path := r.RequestURI
-	if i := strings.IndexByte(path, '?'); i > 0 {
-		path = path[:i]
-	}
-	path = strings.Replace(path, "/", "_", -1)
-	key := r.Method + path
-	if _, ok := metrics_query_count[key]; !ok {
-		metrics_query_count[key] = gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
-			Namespace: "appgo",
-			Subsystem: "http",
-			Name:      "request_counter_" + key,
-			Help:      fmt.Sprintf("Total served %s requests count.", key),
-		}, []string{})
-	}
-	metrics_query_count["all"].Add(1)
-	metrics_query_count[key].Add(1)
+// checkInput validates the decoded input and applies rate limits
+func (h *handler) checkInput(w http.ResponseWriter, r *http.Request,
+	f *httpFunc, input reflect.Value, user appgo.Id) *appgo.ApiError {
+	if errs := f.validate(input); len(errs) > 0 {
+		aerr := appgo.NewApiErr(appgo.ECodeBadRequest, errs.Error())
+		for _, fe := range errs {
+			aerr.Details = append(aerr.Details, &appgo.ErrorDetail{Field: fe.Field, Reason: fe.Rule})
+		}
+		return aerr
+	}
+	if len(h.rateLimits) > 0 {
+		return h.checkRateLimits(w, r, f, input, user)
+	}
+	return nil
+}
 
+func (h *handler) checkPermissions(user appgo.Id, perms []string) *appgo.ApiError {
+	ok, err := h.ts.(PermissionChecker).HasPermissions(user, perms)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  user,
+			"error": err,
+		}).Errorln("failed to check permissions")
+		return appgo.InternalErr
+	}
+	if !ok {
+		return appgo.NewApiErr(appgo.ECodeForbidden,
+			"permission required: "+strings.Join(perms, ", "))
+	}
+	return nil
 }
 
-func (h *handler) authByHeader(r *http.Request) (appgo.Id, appgo.Role) {
-	token := auth.Token(r.Header.Get(appgo.CustomTokenHeaderName))
-	user, role := token.Validate()
-	if user == 0 {
-		return 0, 0
+// newContext returns the context passed to API funcs, it's canceled when
+// the client goes away or the handler's timeout is reached.
+func (h *handler) newContext(w http.ResponseWriter, r *http.Request,
+	user appgo.Id, role appgo.Role, ver int) (context.Context, context.CancelFunc) {
+	// Set by traceRequest unless the handler is served without it
+	rid := appgo.RequestIdFromContext(r.Context())
+	if rid == "" {
+		rid = randomHex(8)
+		w.Header().Set(appgo.RequestIdHeaderName, rid)
 	}
-	if !h.ts.Validate(token) {
-		return 0, 0
+	fields := trace.LogFields(r.Context())
+	fields["requestId"] = rid
+	fields["api"] = h.name
+	if user != 0 {
+		fields["user"] = user
+		trace.FromContext(r.Context()).SetAttributes(attribute.Int64("appgo.user", int64(user)))
 	}
-	return user, role
+	ctx := appgo.WithUser(r.Context(), user, role)
+	ctx = appgo.WithRequestId(ctx, rid)
+	ctx = appgo.WithApiVersion(ctx, ver)
+	ctx = appgo.WithLogger(ctx, log.WithFields(fields))
+	if h.timeout > 0 {
+		return context.WithTimeout(ctx, h.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// formValues drops values of the fields set by the handler itself, e.g.
+// UserId__, clients must not be able to set them
+func formValues(values url.Values) url.Values {
+	ret := make(url.Values, len(values))
+	for k, v := range values {
+		if !strings.HasSuffix(k, "__") {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func apiVersionFromHeader(r *http.Request) int {
@@ -256,12 +395,17 @@ func confVersionFromHeader(r *http.Request) int64 {
 	return strutil.ToInt64(v)
 }
 
-func newHandler(funcSet interface{}, htype HandlerType,
-	ts TokenStore, renderer *render.Render) *handler {
+func newHandler(funcSet interface{}, htype HandlerType, errorMode ErrorMode,
+	ts TokenStore, life *lifecycle, renderer *render.Render) *handler {
 	funcs := make(map[string]*httpFunc)
 	// Let if panic if funSet's type is not right
 	path := ""
 	template := ""
+	summary := ""
+	var timeout time.Duration
+	heartbeat := defaultHeartbeat
+	var permissions []string
+	var rateLimits []*rateLimitSpec
 	t := reflect.TypeOf(funcSet).Elem()
 	if field, ok := t.FieldByName("META"); !ok {
 		log.Panicln("Bad META setting (path, template)")
@@ -271,6 +415,31 @@ func newHandler(funcSet interface{}, htype HandlerType,
 		} else {
 			path = p
 		}
+		summary = field.Tag.Get("summary")
+		permissions = parsePermissions(field.Tag.Get("permissions"))
+		if t := field.Tag.Get("timeout"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil || d <= 0 {
+				log.Panicln("Bad API timeout: ", t)
+			}
+			timeout = d
+		}
+		if t := field.Tag.Get("heartbeat"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil || d <= 0 {
+				log.Panicln("Bad API heartbeat: ", t)
+			}
+			heartbeat = d
+		}
+		if m := field.Tag.Get("errorMode"); m != "" {
+			errorMode = parseErrorMode(m)
+		}
+		if rl := field.Tag.Get("ratelimit"); rl != "" {
+			var err error
+			if rateLimits, err = parseRateLimits(t.Name(), rl); err != nil {
+				log.Panicln(err)
+			}
+		}
 		if htype == HandlerTypeHtml {
 			t := field.Tag.Get("template")
 			template = t
@@ -281,23 +450,28 @@ func newHandler(funcSet interface{}, htype HandlerType,
 	if htype == HandlerTypeJson {
 		methods := []string{"GET", "POST", "PUT", "DELETE"}
 		for _, m := range methods {
+			supported := false
 			for i := 1; i <= maxVersion; i++ { //versions
+				name := m
 				if i > 1 {
-					m += strutil.FromInt(i)
+					name += strutil.FromInt(i)
 				}
-				if fun, err := newHttpFunc(structVal, m); err != nil {
+				if fun, err := newHttpFunc(structVal, name, permissions); err != nil {
 					log.Panicln(err)
 				} else if fun != nil {
-					funcs[m] = fun
-					supports = append(supports, m)
+					funcs[name] = fun
+					supported = true
 				}
 			}
+			if supported {
+				supports = append(supports, m)
+			}
 		}
 		if len(supports) == 0 {
 			log.Panicln("API supports no HTTP method")
 		}
 	} else if htype == HandlerTypeHtml {
-		if fun, err := newHttpFunc(structVal, "HTML"); err != nil {
+		if fun, err := newHttpFunc(structVal, "HTML", permissions); err != nil {
 			log.Panicln(err)
 		} else if fun == nil {
 			log.Panicln("No HTML function for html")
@@ -307,20 +481,47 @@ func newHandler(funcSet interface{}, htype HandlerType,
 	} else {
 		log.Panicln("Bad handler type")
 	}
-	return &handler{htype, path, template, funcs, supports, ts, renderer}
+	for _, f := range funcs {
+		if _, ok := ts.(PermissionChecker); len(f.permissions) > 0 && !ok {
+			log.Panicln("TokenStore needs to implement PermissionChecker")
+		}
+	}
+	for _, f := range funcs {
+		if f.stream && htype != HandlerTypeJson {
+			log.Panicln("Only JSON APIs can stream")
+		}
+		for _, rl := range rateLimits {
+			if rl.field != "" && !f.hasField(rl.field) {
+				log.Panicln("Rate limit field not found: ", rl.field)
+			}
+		}
+	}
+	return &handler{htype, t.Name(), path, summary, template, timeout, heartbeat,
+		errorMode, rateLimits, funcs, supports, ts, life, renderer}
 }
 
-func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
+// permissions declared in META apply to all funcs of the funcSet, those
+// declared on UserId__ or AdminUserId__ only apply to the func itself.
+func newHttpFunc(structVal reflect.Value, fieldName string,
+	permissions []string) (*httpFunc, error) {
 	fieldVal := structVal.MethodByName(fieldName)
 	if !fieldVal.IsValid() {
 		return nil, nil
 	}
+	// Don't append to the slice shared by all funcs
+	permissions = append([]string(nil), permissions...)
 	ftype := fieldVal.Type()
 	inNum := ftype.NumIn()
-	if inNum != 1 {
-		return nil, errors.New("API func needs to have exact 1 parameter")
+	hasContext := false
+	if inNum == 2 {
+		if ftype.In(0) != reflect.TypeOf((*context.Context)(nil)).Elem() {
+			return nil, errors.New("API func's 1st parameter needs to be context.Context")
+		}
+		hasContext = true
+	} else if inNum != 1 {
+		return nil, errors.New("API func needs to have 1 or 2 parameters")
 	}
-	inputType := ftype.In(0)
+	inputType := ftype.In(inNum - 1)
 	dummyInput := false
 	if inputType.Kind() != reflect.Ptr {
 		return nil, errors.New("API func's parameter needs to be a pointer")
@@ -338,6 +539,8 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 		}
 		aa := fromIdField.Tag.Get("allowAnonymous")
 		allowAnonymous = (aa == "true")
+		permissions = append(permissions,
+			parsePermissions(fromIdField.Tag.Get("permissions"))...)
 	}
 	requireAdmin := false
 	if fromIdType, ok := inputType.FieldByName(AdminUserIdFieldName); ok {
@@ -345,6 +548,16 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 		if fromIdType.Type.Kind() != reflect.Int64 {
 			return nil, errors.New("API func's 2nd parameter needs to be Int64")
 		}
+		permissions = append(permissions,
+			parsePermissions(fromIdType.Tag.Get("permissions"))...)
+	}
+	if len(permissions) > 0 {
+		if !requireAuth && !requireAdmin {
+			return nil, errors.New("Permissions need UserId__ or AdminUserId__")
+		}
+		if allowAnonymous {
+			return nil, errors.New("Permissions can't be used with allowAnonymous")
+		}
 	}
 	hasResId := false
 	if resIdType, ok := inputType.FieldByName(ResIdFieldName); ok {
@@ -379,7 +592,81 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 			return nil, errors.New("ConfVer needs to be Int64")
 		}
 	}
+	var upload *uploadSpec
+	if ftype, ok := inputType.FieldByName(FilesFieldName); ok {
+		if ftype.Type != reflect.TypeOf([]*multipart.FileHeader(nil)) {
+			return nil, errors.New("Files needs to be []*multipart.FileHeader")
+		}
+		var err error
+		if upload, err = newUploadSpec(ftype, false); err != nil {
+			return nil, err
+		}
+	}
+	if ftype, ok := inputType.FieldByName(UploadsFieldName); ok {
+		if ftype.Type != reflect.TypeOf([]*UploadedFile(nil)) {
+			return nil, errors.New("Uploads needs to be []*server.UploadedFile")
+		}
+		if upload != nil {
+			return nil, errors.New("Files and Uploads can't be used together")
+		}
+		var err error
+		if upload, err = newUploadSpec(ftype, true); err != nil {
+			return nil, err
+		}
+	}
+	if upload != nil && hasContent {
+		return nil, errors.New("Content can't be used with Files or Uploads")
+	}
+	// Streaming funcs return (<-chan T, error) and need the context to know
+	// when to stop sending
+	stream := false
+	if ftype.NumOut() == 2 && ftype.Out(0).Kind() == reflect.Chan {
+		if ftype.Out(0).ChanDir()&reflect.RecvDir == 0 {
+			return nil, errors.New("Streaming API func needs to return a receivable channel")
+		}
+		if !hasContext {
+			return nil, errors.New("Streaming API func needs a context.Context parameter")
+		}
+		stream = true
+	}
+	inputChecker, err := validate.Compile(inputType, ContentFieldName, RequestFieldName,
+		FilesFieldName, UploadsFieldName)
+	if err != nil {
+		return nil, err
+	}
+	var contentChecker *validate.Validator
+	if hasContent && contentType.Elem().Kind() == reflect.Struct {
+		if contentChecker, err = validate.Compile(contentType.Elem()); err != nil {
+			return nil, err
+		}
+	}
 	return &httpFunc{requireAuth, requireAdmin,
-		hasResId, hasContent, hasRequest, hasConfVer,
-		dummyInput, allowAnonymous, inputType, contentType, fieldVal}, nil
+		hasResId, hasContent, hasRequest, hasConfVer, hasContext,
+		dummyInput, allowAnonymous, inputType, contentType, fieldVal,
+		inputChecker, contentChecker, permissions, upload, stream}, nil
+}
+
+// parsePermissions parses comma separated permission names
+func parsePermissions(tag string) []string {
+	var perms []string
+	for _, p := range strings.Split(tag, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// validate checks the decoded query input and Content__ body against
+// their "validate" tags, all bad fields are returned together.
+func (f *httpFunc) validate(input reflect.Value) validate.Errors {
+	if f.dummyInput {
+		return nil
+	}
+	errs := f.inputChecker.Validate(input.Interface())
+	if f.contentChecker != nil {
+		content := input.Elem().FieldByName(ContentFieldName)
+		errs = append(errs, f.contentChecker.Validate(content.Interface())...)
+	}
+	return errs
 }
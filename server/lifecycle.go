@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30
+
+type lifecycle struct {
+	onStart    []func() error
+	onShutdown []func(ctx context.Context) error
+	// 1 when serving, 0 before start and during drain
+	ready    int32
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Closed once draining starts, so long-lived responses can end
+	drain chan struct{}
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{stop: make(chan struct{}), drain: make(chan struct{})}
+}
+
+// OnStart registers f to run before serving, Serve fails if f fails
+func (s *Server) OnStart(f func() error) {
+	s.life.onStart = append(s.life.onStart, f)
+}
+
+// OnShutdown registers f to run after in-flight requests are drained,
+// e.g. to close the database or redis.Close. Hooks run in reverse order
+// of registration and share the shutdown timeout.
+func (s *Server) OnShutdown(f func(ctx context.Context) error) {
+	s.life.onShutdown = append(s.life.onShutdown, f)
+}
+
+// Stop makes Serve shut down as if it received SIGTERM
+func (s *Server) Stop() {
+	s.life.stopOnce.Do(func() {
+		close(s.life.stop)
+	})
+}
+
+// AddHealth adds a liveness endpoint that is always OK, and a readiness
+// endpoint that fails before the server starts and during drain.
+func (s *Server) AddHealth(livePath, readyPath string) {
+	s.HandleFunc(livePath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	s.HandleFunc(readyPath, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.life.ready) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+func (l *lifecycle) run(servers []*http.Server) error {
+	// Bound before being ready, so failures like ports in use show up here
+	listeners := make([]net.Listener, 0, len(servers))
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for _, srv := range servers {
+		ln, err := net.Listen("tcp", listenAddr(srv))
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	for _, f := range l.onStart {
+		if err := f(); err != nil {
+			closeAll()
+			return err
+		}
+	}
+	errc := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			log.Infoln("listening on ", ln.Addr())
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != http.ErrServerClosed {
+				errc <- err
+			}
+		}(srv, listeners[i])
+	}
+	atomic.StoreInt32(&l.ready, 1)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigc)
+	var err error
+	select {
+	case sig := <-sigc:
+		log.Infoln("received ", sig, ", shutting down")
+	case <-l.stop:
+		log.Infoln("stopped, shutting down")
+	case err = <-errc:
+		log.WithField("error", err).Errorln("server failed, shutting down")
+	}
+	atomic.StoreInt32(&l.ready, 0)
+
+	conf := appgo.Conf.Shutdown
+	// Keep serving while load balancers notice the failing readiness
+	if err == nil && conf.Delay > 0 {
+		time.Sleep(time.Duration(conf.Delay) * time.Second)
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(timeout)*time.Second)
+	defer cancel()
+	close(l.drain)
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			log.WithFields(log.Fields{
+				"addr":  srv.Addr,
+				"error": e,
+			}).Errorln("failed to drain server")
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	for i := len(l.onShutdown) - 1; i >= 0; i-- {
+		if e := l.onShutdown[i](ctx); e != nil {
+			log.WithField("error", e).Errorln("shutdown hook failed")
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// listenAddr defaults like ListenAndServe and ListenAndServeTLS do
+func listenAddr(srv *http.Server) string {
+	if srv.Addr != "" {
+		return srv.Addr
+	}
+	if srv.TLSConfig != nil {
+		return ":https"
+	}
+	return ":http"
+}
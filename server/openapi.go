@@ -0,0 +1,520 @@
+package server
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"github.com/oxfeeefeee/appgo/toolkit/validate"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openApiVersion      = "3.0.0"
+	openApiTokenScheme  = "appgoToken"
+	openApiJsonMimeType = "application/json"
+)
+
+var (
+	pathVarRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+	idType        = reflect.TypeOf(appgo.Id(0))
+	timeType      = reflect.TypeOf(time.Time{})
+)
+
+type OpenApiDoc struct {
+	OpenApi    string                                  `json:"openapi"`
+	Info       OpenApiInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenApiOperation `json:"paths"`
+	Components OpenApiComponents                       `json:"components"`
+}
+
+type OpenApiInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenApiComponents struct {
+	Schemas         map[string]*OpenApiSchema         `json:"schemas,omitempty"`
+	SecuritySchemes map[string]*OpenApiSecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type OpenApiSecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenApiOperation struct {
+	OperationId string                       `json:"operationId,omitempty"`
+	Summary     string                       `json:"summary,omitempty"`
+	Description string                       `json:"description,omitempty"`
+	Tags        []string                     `json:"tags,omitempty"`
+	Parameters  []*OpenApiParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenApiRequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenApiResponse  `json:"responses"`
+	Security    []map[string][]string        `json:"security,omitempty"`
+	Versions    map[string]*OpenApiOperation `json:"x-appgo-versions,omitempty"`
+	Permissions []string                     `json:"x-appgo-permissions,omitempty"`
+}
+
+type OpenApiParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenApiSchema `json:"schema,omitempty"`
+}
+
+type OpenApiRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenApiMediaType `json:"content"`
+}
+
+type OpenApiResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*OpenApiMediaType `json:"content,omitempty"`
+}
+
+type OpenApiMediaType struct {
+	Schema *OpenApiSchema `json:"schema,omitempty"`
+}
+
+type OpenApiSchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Items                *OpenApiSchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenApiSchema `json:"properties,omitempty"`
+	AdditionalProperties *OpenApiSchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty"`
+	Maximum              *float64                  `json:"maximum,omitempty"`
+	MinLength            *int                      `json:"minLength,omitempty"`
+	MaxLength            *int                      `json:"maxLength,omitempty"`
+}
+
+// AddOpenApi serves the OpenAPI 3 document of all REST handlers on path.
+// The document is built on every request, so handlers added later are included.
+func (s *Server) AddOpenApi(path string) {
+	f := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", openApiJsonMimeType)
+		encoder := json.NewEncoder(w)
+		if appgo.Conf.DevMode {
+			encoder.SetIndent("", "  ")
+		}
+		if err := encoder.Encode(s.OpenApi()); err != nil {
+			log.WithField("error", err).Error("Failed to encode OpenAPI doc")
+		}
+	}
+	s.HandleFunc(path, f).Methods("GET")
+}
+
+// OpenApi builds an OpenAPI 3 document from the handlers registered by AddRest
+func (s *Server) OpenApi() *OpenApiDoc {
+	doc := &OpenApiDoc{
+		OpenApi: openApiVersion,
+		Info: OpenApiInfo{
+			Title:       appgo.Conf.OpenApi.Title,
+			Version:     appgo.Conf.OpenApi.Version,
+			Description: appgo.Conf.OpenApi.Description,
+		},
+		Paths: make(map[string]map[string]*OpenApiOperation),
+	}
+	sb := newSchemaBuilder()
+	sb.schemaOf(reflect.TypeOf(appgo.ApiError{}))
+	for _, r := range s.routes {
+		path := pathVarRegexp.ReplaceAllString(r.path, "{$1}")
+		ops, ok := doc.Paths[path]
+		if !ok {
+			ops = make(map[string]*OpenApiOperation)
+			doc.Paths[path] = ops
+		}
+		for method, op := range r.handler.openApiOperations(path, sb) {
+			ops[method] = op
+		}
+	}
+	doc.Components = OpenApiComponents{
+		Schemas: sb.schemas,
+		SecuritySchemes: map[string]*OpenApiSecurityScheme{
+			openApiTokenScheme: {
+				Type:        "apiKey",
+				In:          "header",
+				Name:        appgo.CustomTokenHeaderName,
+				Description: "Token returned by login APIs",
+			},
+		},
+	}
+	return doc
+}
+
+// openApiOperations returns operations keyed by lower case HTTP method,
+// later API versions of the same method go to "x-appgo-versions".
+func (h *handler) openApiOperations(path string, sb *schemaBuilder) map[string]*OpenApiOperation {
+	versions := make(map[string][]int)
+	for name := range h.funcs {
+		method, ver := splitFuncName(name)
+		versions[method] = append(versions[method], ver)
+	}
+	ret := make(map[string]*OpenApiOperation)
+	for method, vers := range versions {
+		sort.Ints(vers)
+		var primary *OpenApiOperation
+		for _, v := range vers {
+			name := method
+			if v > 1 {
+				name += strutil.FromInt(v)
+			}
+			op := h.funcs[name].openApiOperation(path, sb)
+			op.OperationId = h.name + "_" + name
+			if h.errorMode == ErrorModeProblem {
+				op.Responses["default"].Content[problemMimeType] = &OpenApiMediaType{
+					Schema: sb.schemaOf(reflect.TypeOf(Problem{})),
+				}
+			}
+			op.Summary = h.summary
+			if h.name != "" {
+				op.Tags = []string{h.name}
+			}
+			if len(vers) > 1 || v > 1 {
+				op.Parameters = append(op.Parameters, versionParameter(vers, v == vers[0]))
+			}
+			if primary == nil {
+				primary = op
+			} else {
+				if primary.Versions == nil {
+					primary.Versions = make(map[string]*OpenApiOperation)
+				}
+				primary.Versions[strutil.FromInt(v)] = op
+			}
+		}
+		ret[strings.ToLower(method)] = primary
+	}
+	return ret
+}
+
+func (f *httpFunc) openApiOperation(path string, sb *schemaBuilder) *OpenApiOperation {
+	op := &OpenApiOperation{
+		Responses: map[string]*OpenApiResponse{
+			"default": {
+				Description: "Error, carried in the body as errcode and errmsg",
+				Content:     jsonContent(&OpenApiSchema{Ref: schemaRef("ApiError")}),
+			},
+		},
+	}
+	for _, m := range pathVarRegexp.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, &OpenApiParameter{
+			Name:     m[1],
+			In:       "path",
+			Required: true,
+			Schema:   &OpenApiSchema{Type: "string"},
+		})
+	}
+	if !f.dummyInput {
+		op.Parameters = append(op.Parameters, queryParameters(f.inputType, sb)...)
+	}
+	if f.hasContent {
+		op.RequestBody = &OpenApiRequestBody{
+			Required: true,
+			Content:  jsonContent(sb.schemaOf(f.contentType)),
+		}
+	}
+	if f.upload != nil {
+		form := f.upload.form
+		if form == "" {
+			form = "file"
+		}
+		op.RequestBody = &OpenApiRequestBody{
+			Required: true,
+			Content: map[string]*OpenApiMediaType{
+				"multipart/form-data": {Schema: &OpenApiSchema{
+					Type: "object",
+					Properties: map[string]*OpenApiSchema{
+						form: {
+							Type:  "array",
+							Items: &OpenApiSchema{Type: "string", Format: "binary"},
+						},
+					},
+				}},
+			},
+		}
+	}
+	if f.requireAuth {
+		op.Security = []map[string][]string{{openApiTokenScheme: {}}}
+		if f.allowAnonymous {
+			op.Security = append(op.Security, map[string][]string{})
+		}
+	} else if f.requireAdmin {
+		op.Security = []map[string][]string{{openApiTokenScheme: {}}}
+		op.Description = "Requires admin role"
+	}
+	op.Permissions = f.permissions
+	ok := &OpenApiResponse{Description: "OK"}
+	if ftype := f.funcValue.Type(); f.stream {
+		schema := sb.schemaOf(ftype.Out(0).Elem())
+		ok.Description = "Stream of Server-Sent Events, or NDJSON if accepted"
+		ok.Content = map[string]*OpenApiMediaType{
+			sseMimeType:    {Schema: schema},
+			ndjsonMimeType: {Schema: schema},
+		}
+	} else if ftype.NumOut() >= 2 {
+		ok.Content = jsonContent(sb.schemaOf(ftype.Out(0)))
+	} else {
+		ok.Content = jsonContent(&OpenApiSchema{Type: "object"})
+	}
+	op.Responses["200"] = ok
+	return op
+}
+
+func queryParameters(t reflect.Type, sb *schemaBuilder) []*OpenApiParameter {
+	var params []*OpenApiParameter
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || isMagicField(field.Name) {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			params = append(params, queryParameters(field.Type, sb)...)
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("schema"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+			if name == "-" {
+				continue
+			}
+		}
+		schema := sb.schemaOf(field.Type)
+		params = append(params, &OpenApiParameter{
+			Name:     name,
+			In:       "query",
+			Required: applyRules(schema, field),
+			Schema:   schema,
+		})
+	}
+	return params
+}
+
+func versionParameter(vers []int, optional bool) *OpenApiParameter {
+	enum := make([]string, 0, len(vers))
+	for _, v := range vers {
+		enum = append(enum, strutil.FromInt(v))
+	}
+	return &OpenApiParameter{
+		Name:        appgo.CustomVersionHeaderName,
+		In:          "header",
+		Description: "API version, defaults to the lowest one",
+		Required:    !optional,
+		Schema:      &OpenApiSchema{Type: "string", Enum: enum},
+	}
+}
+
+type schemaBuilder struct {
+	schemas map[string]*OpenApiSchema
+	names   map[reflect.Type]string
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{
+		make(map[string]*OpenApiSchema),
+		make(map[reflect.Type]string),
+	}
+}
+
+func (sb *schemaBuilder) schemaOf(t reflect.Type) *OpenApiSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == idType:
+		return &OpenApiSchema{Type: "string", Format: "int64"}
+	case t == timeType:
+		return &OpenApiSchema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenApiSchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenApiSchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &OpenApiSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &OpenApiSchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &OpenApiSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenApiSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &OpenApiSchema{Type: "string", Format: "byte"}
+		}
+		return &OpenApiSchema{Type: "array", Items: sb.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &OpenApiSchema{Type: "object", AdditionalProperties: sb.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.structSchema(t)
+		}
+		if name, ok := sb.names[t]; ok {
+			return &OpenApiSchema{Ref: schemaRef(name)}
+		}
+		name := sb.uniqueName(t)
+		sb.names[t] = name
+		sb.schemas[name] = sb.structSchema(t)
+		return &OpenApiSchema{Ref: schemaRef(name)}
+	default:
+		return &OpenApiSchema{}
+	}
+}
+
+func (sb *schemaBuilder) structSchema(t reflect.Type) *OpenApiSchema {
+	s := &OpenApiSchema{
+		Type:       "object",
+		Properties: make(map[string]*OpenApiSchema),
+	}
+	sb.addProperties(s, t)
+	return s
+}
+
+func (sb *schemaBuilder) addProperties(s *OpenApiSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		asString := false
+		if tag := field.Tag.Get("json"); tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				asString = asString || opt == "string"
+			}
+		} else if field.Anonymous {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				sb.addProperties(s, ft)
+				continue
+			}
+		}
+		var prop *OpenApiSchema
+		if asString {
+			prop = &OpenApiSchema{Type: "string"}
+		} else {
+			prop = sb.schemaOf(field.Type)
+		}
+		if applyRules(prop, field) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = prop
+	}
+}
+
+func (sb *schemaBuilder) uniqueName(t reflect.Type) string {
+	name := t.Name()
+	if _, ok := sb.schemas[name]; !ok {
+		return name
+	}
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	name = pkg + "." + name
+	for i := 2; ; i++ {
+		if _, ok := sb.schemas[name]; !ok {
+			return name
+		}
+		name = pkg + "." + t.Name() + strutil.FromInt(i)
+	}
+}
+
+// applyRules copies "validate" tag rules of field into schema and reports
+// whether the field is required.
+func applyRules(schema *OpenApiSchema, field reflect.StructField) bool {
+	rules, err := validate.ParseTag(field.Tag.Get(validate.TagName))
+	if err != nil {
+		return false
+	}
+	required := false
+	for _, r := range rules {
+		if r.Name == validate.RuleRequired {
+			required = true
+		}
+	}
+	// Referenced schemas are shared, only their own fields have rules
+	if schema.Ref != "" {
+		return required
+	}
+	for _, r := range rules {
+		num, _ := strconv.ParseFloat(r.Arg, 64)
+		n := int(num)
+		switch r.Name {
+		case validate.RuleEnum:
+			schema.Enum = strings.Split(r.Arg, "|")
+		case validate.RuleRegex:
+			schema.Pattern = r.Arg
+		case validate.RuleMobile:
+			schema.Format = "mobile"
+		case validate.RuleEmail:
+			schema.Format = "email"
+		case validate.RuleMin:
+			if schema.Type == "string" {
+				schema.MinLength = &n
+			} else if schema.Type == "integer" || schema.Type == "number" {
+				schema.Minimum = &num
+			}
+		case validate.RuleMax:
+			if schema.Type == "string" {
+				schema.MaxLength = &n
+			} else if schema.Type == "integer" || schema.Type == "number" {
+				schema.Maximum = &num
+			}
+		case validate.RuleLen:
+			if schema.Type == "string" {
+				schema.MinLength, schema.MaxLength = &n, &n
+			}
+		}
+	}
+	return required
+}
+
+func schemaRef(name string) string {
+	return "#/components/schemas/" + name
+}
+
+func jsonContent(schema *OpenApiSchema) map[string]*OpenApiMediaType {
+	return map[string]*OpenApiMediaType{
+		openApiJsonMimeType: {Schema: schema},
+	}
+}
+
+// splitFuncName splits API func names like "POST2" into method and version
+func splitFuncName(name string) (string, int) {
+	i := strings.IndexAny(name, "0123456789")
+	if i < 0 {
+		return name, 1
+	}
+	return name[:i], strutil.ToInt(name[i:])
+}
+
+func isMagicField(name string) bool {
+	return strings.HasSuffix(name, "__")
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+type openApiAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type openApiUser struct {
+	Name    string          `json:"name" validate:"required,max=10"`
+	Address *openApiAddress `json:"address" validate:"required"`
+	Note    string          `json:"note"`
+}
+
+func TestOpenApiRequired(t *testing.T) {
+	sb := newSchemaBuilder()
+	ref := sb.schemaOf(reflect.TypeOf(openApiUser{}))
+	user := sb.schemas["openApiUser"]
+	assert.Equal(t, schemaRef("openApiUser"), ref.Ref)
+	assert.Equal(t, []string{"name", "address"}, user.Required)
+	assert.Equal(t, 10, *user.Properties["name"].MaxLength)
+	assert.Equal(t, schemaRef("openApiAddress"), user.Properties["address"].Ref)
+	assert.Equal(t, []string{"city"}, sb.schemas["openApiAddress"].Required)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	_ ErrorMode = iota
+	// Status 200 with errcode and errmsg, what old clients expect
+	ErrorModeLegacy
+	// Real HTTP statuses with errcode and errmsg
+	ErrorModeStatus
+	// Real HTTP statuses with RFC 7807 application/problem+json bodies
+	ErrorModeProblem
+)
+
+const (
+	problemMimeType = "application/problem+json"
+	// Tokens go to a custom header, see appgo.CustomTokenHeaderName
+	wwwAuthenticate = `AppgoToken realm="appgo"`
+)
+
+type ErrorMode int
+
+// Problem is the RFC 7807 body of errors, errcode, details and data are
+// kept as extension members so clients can still tell app errors apart.
+type Problem struct {
+	Type     string               `json:"type"`
+	Title    string               `json:"title"`
+	Status   int                  `json:"status"`
+	Detail   string               `json:"detail,omitempty"`
+	Instance string               `json:"instance,omitempty"`
+	ErrCode  appgo.ErrCode        `json:"errcode"`
+	Details  []*appgo.ErrorDetail `json:"details,omitempty"`
+	Data     interface{}          `json:"data,omitempty"`
+}
+
+func parseErrorMode(s string) ErrorMode {
+	switch strings.ToLower(s) {
+	case "", "legacy":
+		return ErrorModeLegacy
+	case "status":
+		return ErrorModeStatus
+	case "problem":
+		return ErrorModeProblem
+	}
+	log.Panicln("Bad error mode: ", s)
+	return 0
+}
+
+func newProblem(err *appgo.ApiError, r *http.Request) *Problem {
+	status := err.HttpCode()
+	typ := "about:blank"
+	if base := appgo.Conf.Errors.ProblemTypeBase; base != "" {
+		typ = base + strutil.FromInt(int(err.Code))
+	}
+	return &Problem{
+		Type:     typ,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   err.Msg,
+		Instance: r.URL.Path,
+		ErrCode:  err.Code,
+		Details:  err.Details,
+		Data:     err.Data,
+	}
+}
+
+// errorModeOf returns the mode of the handler, unless the client is too
+// old for it or asks for problem+json.
+func (h *handler) errorModeOf(r *http.Request) ErrorMode {
+	if h.errorMode == ErrorModeLegacy {
+		return ErrorModeLegacy
+	}
+	ver := apiVersionFromHeader(r)
+	if ver < 1 {
+		ver = 1
+	}
+	if ver < appgo.Conf.Errors.LegacyBelowVersion {
+		return ErrorModeLegacy
+	}
+	if strings.Contains(r.Header.Get("Accept"), problemMimeType) {
+		return ErrorModeProblem
+	}
+	return h.errorMode
+}
+
+func (h *handler) renderProblem(w http.ResponseWriter, r *http.Request, err *appgo.ApiError) {
+	p := newProblem(err, r)
+	w.Header().Set("Content-Type", problemMimeType)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"data":  p,
+		}).Error("Error rendering problem")
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorModeOf(t *testing.T) {
+	conf := appgo.Conf.Errors
+	defer func() { appgo.Conf.Errors = conf }()
+	appgo.Conf.Errors.LegacyBelowVersion = 3
+
+	cases := []struct {
+		mode    ErrorMode
+		version string
+		accept  string
+		want    ErrorMode
+	}{
+		{ErrorModeLegacy, "5", problemMimeType, ErrorModeLegacy},
+		// Older clients get legacy errors, no version header means 1
+		{ErrorModeStatus, "", "", ErrorModeLegacy},
+		{ErrorModeStatus, "2", problemMimeType, ErrorModeLegacy},
+		{ErrorModeStatus, "3", "", ErrorModeStatus},
+		{ErrorModeStatus, "3", "application/json, " + problemMimeType, ErrorModeProblem},
+		{ErrorModeProblem, "4", "application/json", ErrorModeProblem},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.version != "" {
+			r.Header.Set(appgo.CustomVersionHeaderName, c.version)
+		}
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		h := &handler{errorMode: c.mode}
+		assert.Equal(t, c.want, h.errorModeOf(r), "%+v", c)
+	}
+
+	appgo.Conf.Errors.LegacyBelowVersion = 0
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, ErrorModeStatus, (&handler{errorMode: ErrorModeStatus}).errorModeOf(r))
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	gkmetrics "github.com/go-kit/kit/metrics"
+	gkprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/gorilla/mux"
+	"github.com/oxfeeefeee/appgo"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics of API handlers, labeled by the route template instead of the
+// raw path so that ids in paths don't blow up the number of series.
+type promMetrics struct {
+	requests gkmetrics.Counter
+	errors   gkmetrics.Counter
+	latency  gkmetrics.Histogram
+	inFlight gkmetrics.Gauge
+}
+
+var (
+	prom     *promMetrics
+	promOnce sync.Once
+)
+
+func initPrometheus() {
+	if !appgo.Conf.Prometheus.Enable {
+		return
+	}
+	promOnce.Do(func() {
+		prom = &promMetrics{
+			gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "appgo",
+				Subsystem: "http",
+				Name:      "requests_total",
+				Help:      "Total served requests.",
+			}, []string{"method", "route", "version", "status", "errcode"}),
+			gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "appgo",
+				Subsystem: "http",
+				Name:      "errors_total",
+				Help:      "Total requests ended with an ApiError.",
+			}, []string{"method", "route", "errcode"}),
+			gkprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "appgo",
+				Subsystem: "http",
+				Name:      "request_duration_seconds",
+				Help:      "Time spent serving requests.",
+				Buckets:   stdprometheus.DefBuckets,
+			}, []string{"method", "route", "version"}),
+			gkprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Namespace: "appgo",
+				Subsystem: "http",
+				Name:      "requests_in_flight",
+				Help:      "Requests being served.",
+			}, []string{"method", "route"}),
+		}
+	})
+}
+
+// statusWriter records the status code and the ErrCode of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	errCode appgo.ErrCode
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// observe starts measuring a request, call the returned func when done
+func (m *promMetrics) observe(r *http.Request, w *statusWriter, ver int) func() {
+	route := routeTemplate(r)
+	begin := time.Now()
+	m.inFlight.With("method", r.Method, "route", route).Add(1)
+	return func() {
+		m.inFlight.With("method", r.Method, "route", route).Add(-1)
+		version := "1"
+		if ver > 1 && ver <= maxVersion {
+			version = strconv.Itoa(ver)
+		}
+		m.latency.With("method", r.Method, "route", route, "version", version).
+			Observe(time.Since(begin).Seconds())
+		errCode := appgo.ErrCode(appgo.ECodeOK)
+		if w.errCode != 0 {
+			errCode = w.errCode
+			m.errors.With("method", r.Method, "route", route,
+				"errcode", strconv.Itoa(int(errCode))).Add(1)
+		}
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requests.With("method", r.Method, "route", route, "version", version,
+			"status", strconv.Itoa(status), "errcode", strconv.Itoa(int(errCode))).Add(1)
+	}
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unknown"
+}
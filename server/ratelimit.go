@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/negroni"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/ratelimit"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"github.com/unrolled/render"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	rateLimitKeyIp    = "ip"
+	rateLimitKeyUser  = "user"
+	rateLimitKeyField = "field:"
+)
+
+// KeyFunc returns the rate limit bucket of a request, requests with an
+// empty key are not limited.
+type KeyFunc func(r *http.Request) string
+
+// rateLimitSpec comes from the "ratelimit" tag of META, limits separated
+// by ";" all apply:
+//
+//	ratelimit:"5/m,ip"                    per client IP
+//	ratelimit:"100/h,user"                per user, per IP for anonymous users
+//	ratelimit:"1/m,field:Mobile;20/h,ip"  per value of an input or Content__
+//	                                      field, and per client IP
+type rateLimitSpec struct {
+	limiter *ratelimit.Limiter
+	key     string
+	field   string
+}
+
+// RateLimit is a middleware limiting requests by key, e.g. KeyByIp.
+// Requests are let through if redis fails.
+func RateLimit(limiter *ratelimit.Limiter, key KeyFunc) negroni.Handler {
+	// Only renders errors
+	h := &handler{
+		htype:     HandlerTypeJson,
+		errorMode: parseErrorMode(appgo.Conf.Errors.Mode),
+		renderer:  render.New(),
+	}
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if k := key(r); k != "" {
+			if aerr := allowRequest(w, limiter, k); aerr != nil {
+				h.renderError(w, r, aerr)
+				return
+			}
+		}
+		next(w, r)
+	})
+}
+
+func KeyByIp(r *http.Request) string {
+	return ClientIp(r)
+}
+
+// KeyByUser limits anonymous requests by IP
+func KeyByUser(r *http.Request) string {
+	if user, _ := auth.Token(r.Header.Get(appgo.CustomTokenHeaderName)).Validate(); user != 0 {
+		return "u" + user.String()
+	}
+	return ClientIp(r)
+}
+
+// ClientIp takes X-Forwarded-For or X-Real-IP into account if
+// Conf.RateLimit.TrustProxy is set. Clients can send any X-Forwarded-For,
+// only the entries appended by the Conf.RateLimit.TrustedHops proxies count.
+func ClientIp(r *http.Request) string {
+	if appgo.Conf.RateLimit.TrustProxy {
+		if fwd := r.Header["X-Forwarded-For"]; len(fwd) > 0 {
+			return forwardedIp(strings.Join(fwd, ","), appgo.Conf.RateLimit.TrustedHops)
+		}
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedIp returns the entry of X-Forwarded-For added by the outermost
+// of hops proxies
+func forwardedIp(fwd string, hops int) string {
+	if hops <= 0 {
+		hops = 1
+	}
+	ips := strings.Split(fwd, ",")
+	i := len(ips) - hops
+	if i < 0 {
+		i = 0
+	}
+	return strings.TrimSpace(ips[i])
+}
+
+func parseRateLimits(name, tag string) ([]*rateLimitSpec, error) {
+	var specs []*rateLimitSpec
+	for i, s := range strings.Split(tag, ";") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, ",", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Bad ratelimit: " + s)
+		}
+		limit, err := ratelimit.ParseLimit(parts[0])
+		if err != nil {
+			return nil, errors.New("Bad ratelimit: " + s)
+		}
+		spec := &rateLimitSpec{
+			limiter: ratelimit.New("api:"+name+":"+strutil.FromInt(i), limit),
+			key:     strings.TrimSpace(parts[1]),
+		}
+		if strings.HasPrefix(spec.key, rateLimitKeyField) {
+			spec.field = strings.TrimPrefix(spec.key, rateLimitKeyField)
+			spec.key = rateLimitKeyField
+		} else if spec.key != rateLimitKeyIp && spec.key != rateLimitKeyUser {
+			return nil, errors.New("Bad ratelimit key: " + spec.key)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// checkRateLimits is called once the input is decoded, so limits keyed by
+// fields see the values passed to the API func.
+func (h *handler) checkRateLimits(w http.ResponseWriter, r *http.Request,
+	f *httpFunc, input reflect.Value, user appgo.Id) *appgo.ApiError {
+	for _, spec := range h.rateLimits {
+		var key string
+		switch spec.key {
+		case rateLimitKeyIp:
+			key = ClientIp(r)
+		case rateLimitKeyUser:
+			if user != 0 && user != appgo.AnonymousId {
+				key = "u" + user.String()
+			} else {
+				key = ClientIp(r)
+			}
+		case rateLimitKeyField:
+			key = f.fieldValue(input, spec.field)
+		}
+		if key == "" {
+			continue
+		}
+		if aerr := allowRequest(w, spec.limiter, key); aerr != nil {
+			return aerr
+		}
+	}
+	return nil
+}
+
+// fieldValue looks for name in the input, then in Content__
+func (f *httpFunc) fieldValue(input reflect.Value, name string) string {
+	if f.dummyInput {
+		return ""
+	}
+	s := input.Elem()
+	v := s.FieldByName(name)
+	if !v.IsValid() && f.hasContent {
+		if content := s.FieldByName(ContentFieldName); !content.IsNil() {
+			v = content.Elem().FieldByName(name)
+		}
+	}
+	if !v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// hasField tells if fieldValue can find name
+func (f *httpFunc) hasField(name string) bool {
+	if f.dummyInput {
+		return false
+	}
+	if _, ok := f.inputType.FieldByName(name); ok {
+		return true
+	}
+	if f.hasContent {
+		_, ok := f.contentType.Elem().FieldByName(name)
+		return ok
+	}
+	return false
+}
+
+func allowRequest(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) *appgo.ApiError {
+	ret, err := limiter.Allow(key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   key,
+			"error": err,
+		}).Errorln("failed to check rate limit")
+		return nil
+	}
+	w.Header().Set("X-RateLimit-Limit", strutil.FromInt(limiter.Limit().Count))
+	w.Header().Set("X-RateLimit-Remaining", strutil.FromInt(ret.Remaining))
+	if !ret.Allowed {
+		return ratelimit.TooManyRequests(ret.RetryAfter)
+	}
+	return nil
+}
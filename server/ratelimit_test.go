@@ -0,0 +1,29 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	conf := appgo.Conf.RateLimit
+	defer func() { appgo.Conf.RateLimit = conf }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	r.Header.Add("X-Forwarded-For", "3.3.3.3")
+
+	appgo.Conf.RateLimit.TrustProxy = false
+	assert.Equal(t, "10.0.0.1", ClientIp(r))
+
+	// Entries before the ones added by the trusted proxies are spoofable
+	appgo.Conf.RateLimit.TrustProxy = true
+	assert.Equal(t, "3.3.3.3", ClientIp(r))
+	appgo.Conf.RateLimit.TrustedHops = 2
+	assert.Equal(t, "2.2.2.2", ClientIp(r))
+	appgo.Conf.RateLimit.TrustedHops = 5
+	assert.Equal(t, "1.1.1.1", ClientIp(r))
+}
@@ -3,6 +3,8 @@ package server
 import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"github.com/oxfeeefeee/appgo/trace"
 	"net/http"
 )
 
@@ -16,9 +18,28 @@ func (h *handler) renderData(w http.ResponseWriter, v interface{}) {
 	}
 }
 
-func (h *handler) renderError(w http.ResponseWriter, err *appgo.ApiError) {
+func (h *handler) renderError(w http.ResponseWriter, r *http.Request, err *appgo.ApiError) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.errCode = err.Code
+	}
+	trace.RecordApiError(r.Context(), err)
+	err = err.Localize(r.Header.Get("Accept-Language"))
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strutil.FromInt(err.RetryAfter))
+	}
 	if h.htype == HandlerTypeJson {
-		h.renderJSON(w, err)
+		mode := h.errorModeOf(r)
+		if mode != ErrorModeLegacy && err.HttpCode() == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", wwwAuthenticate)
+		}
+		switch mode {
+		case ErrorModeStatus:
+			h.renderJSONStatus(w, err.HttpCode(), err)
+		case ErrorModeProblem:
+			h.renderProblem(w, r, err)
+		default:
+			h.renderJSON(w, err)
+		}
 	} else if h.htype == HandlerTypeHtml {
 		err := h.renderer.Text(w, err.HttpCode(), err.Error())
 		if err != nil {
@@ -30,7 +51,11 @@ func (h *handler) renderError(w http.ResponseWriter, err *appgo.ApiError) {
 }
 
 func (h *handler) renderJSON(w http.ResponseWriter, v interface{}) {
-	err := h.renderer.JSON(w, http.StatusOK, v)
+	h.renderJSONStatus(w, http.StatusOK, v)
+}
+
+func (h *handler) renderJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	err := h.renderer.JSON(w, status, v)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -1,12 +1,14 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
-	"github.com/meatballhat/negroni-logrus"
 	"github.com/oxfeeefeee/appgo"
 	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/phyber/negroni-gzip/gzip"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/cors"
@@ -21,13 +23,27 @@ type Server struct {
 	ts          TokenStore
 	middlewares []negroni.Handler
 	ver         *versioning
+	routes      []*route
+	life        *lifecycle
+	errorMode   ErrorMode
 	*mux.Router
 }
 
+type route struct {
+	path    string
+	handler *handler
+}
+
 type TokenStore interface {
 	Validate(token auth.Token) bool
 }
 
+// PermissionChecker is implemented by TokenStores that support the
+// "permissions" tag of handlers, all of perms are required.
+type PermissionChecker interface {
+	HasPermissions(id appgo.Id, perms []string) (bool, error)
+}
+
 type MetricsSchema interface {
 	KeysGen(r *http.Request) map[string]string
 }
@@ -38,12 +54,18 @@ func NewServer(ts TokenStore, middlewares []negroni.Handler,
 		m := newMetrics(s)
 		middlewares = append(middlewares, m)
 	}
-	return &Server{
+	s := &Server{
 		ts,
 		middlewares,
 		newVersioning(),
+		nil,
+		newLifecycle(),
+		parseErrorMode(appgo.Conf.Errors.Mode),
 		mux.NewRouter(),
 	}
+	// Hooks run in reverse order, spans of other hooks are exported too
+	s.OnShutdown(trace.Shutdown)
+	return s
 }
 
 func (s *Server) AddRest(path string, rests []interface{}) {
@@ -52,12 +74,19 @@ func (s *Server) AddRest(path string, rests []interface{}) {
 		IndentJSON:    appgo.Conf.DevMode,
 		IsDevelopment: appgo.Conf.DevMode,
 	})
+	initPrometheus()
 	for _, api := range rests {
-		h := newHandler(api, HandlerTypeJson, s.ts, renderer)
+		h := newHandler(api, HandlerTypeJson, s.errorMode, s.ts, s.life, renderer)
 		s.Handle(path+h.path, h).Methods(h.supports...)
+		s.routes = append(s.routes, &route{path + h.path, h})
 	}
 }
 
+// SetErrorMode overrides Conf.Errors.Mode for handlers added afterwards
+func (s *Server) SetErrorMode(mode ErrorMode) {
+	s.errorMode = mode
+}
+
 func (s *Server) AddHtml(path, layout string, htmls []interface{}, funcs template.FuncMap) {
 	// add "static" template function
 	static := func(path string) string {
@@ -74,8 +103,9 @@ func (s *Server) AddHtml(path, layout string, htmls []interface{}, funcs templat
 		Funcs:         []template.FuncMap{funcs},
 		IsDevelopment: appgo.Conf.DevMode,
 	})
+	initPrometheus()
 	for _, api := range htmls {
-		h := newHandler(api, HandlerTypeHtml, s.ts, renderer)
+		h := newHandler(api, HandlerTypeHtml, s.errorMode, s.ts, s.life, renderer)
 		s.Handle(path+h.path, h).Methods("GET")
 	}
 }
@@ -97,28 +127,46 @@ func (s *Server) AddAppleAppSiteAsso(content []byte) {
 	s.HandleFunc("/apple-app-site-association", f)
 }
 
-func (s *Server) Serve() {
+// AddJwks serves the public keys of JWT mode as a JSON Web Key Set
+func (s *Server) AddJwks(path string) {
+	f := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(auth.Jwks()); err != nil {
+			log.WithField("error", err).Error("Failed to encode JWKS")
+		}
+	}
+	s.HandleFunc(path, f).Methods("GET")
+}
+
+// Serve blocks until SIGTERM, SIGINT or Stop, then drains in-flight
+// requests and runs the shutdown hooks. See Conf.Shutdown.
+func (s *Server) Serve() error {
+	// Admin APIs would reject every call otherwise
+	if tc := appgo.Conf.Tls; tc.AdminClientCert && (!tc.Enable || tc.ClientCAFile == "") {
+		return errors.New("AdminClientCert needs Tls.Enable and ClientCAFile")
+	}
+	var servers []*http.Server
 	if appgo.Conf.Pprof.Enable {
-		go func() {
-			log.Infoln(http.ListenAndServe(":"+appgo.Conf.Pprof.Port, nil))
-		}()
+		servers = append(servers, &http.Server{
+			Addr:    ":" + appgo.Conf.Pprof.Port,
+			Handler: http.DefaultServeMux,
+		})
 	}
 	if appgo.Conf.Prometheus.Enable {
-		go func() {
-			mux := http.NewServeMux()
-			mux.Handle("/metrics", prometheus.Handler())
-			log.Infoln(http.ListenAndServe(":"+appgo.Conf.Prometheus.Port, mux))
-		}()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prometheus.Handler())
+		servers = append(servers, &http.Server{
+			Addr:    ":" + appgo.Conf.Prometheus.Port,
+			Handler: mux,
+		})
 	}
 
 	n := negroni.New()
+	n.UseFunc(traceRequest)
 	rec := negroni.NewRecovery()
 	rec.StackAll = true
 	n.Use(rec)
-	llog := negronilogrus.NewCustomMiddleware(
-		appgo.Conf.LogLevel, &log.TextFormatter{}, "appgo")
-	llog.Logger = log.StandardLogger()
-	n.Use(llog)
+	n.UseFunc(logRequest)
 	n.Use(cors.New(corsOptions()))
 	for _, mw := range s.middlewares {
 		n.Use(mw)
@@ -127,7 +175,20 @@ func (s *Server) Serve() {
 		n.Use(gzip.Gzip(gzip.BestSpeed))
 	}
 	n.UseHandler(s)
-	n.Run(appgo.Conf.Negroni.Port)
+	srv := &http.Server{
+		Addr:    appgo.Conf.Negroni.Port,
+		Handler: n,
+	}
+	if tc := appgo.Conf.Tls; tc.Enable {
+		if err := configureTls(srv); err != nil {
+			return err
+		}
+		if tc.RedirectPort != "" {
+			servers = append(servers, newRedirectServer(tc.RedirectPort, srv.Addr))
+		}
+	}
+	servers = append(servers, srv)
+	return s.life.run(servers)
 }
 
 func GetUserFromToken(r *http.Request) appgo.Id {
@@ -144,6 +205,7 @@ func corsOptions() cors.Options {
 		AllowedOrigins:     origins,
 		AllowedMethods:     methods,
 		AllowedHeaders:     headers,
+		ExposedHeaders:     []string{appgo.CustomTokenHeaderName},
 		OptionsPassthrough: appgo.Conf.Cors.OptionsPassthrough,
 		Debug:              appgo.Conf.Cors.Debug,
 	}
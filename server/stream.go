@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	sseMimeType    = "text/event-stream"
+	ndjsonMimeType = "application/x-ndjson"
+
+	defaultHeartbeat = 15 * time.Second
+)
+
+// Event can be sent by streaming API funcs to set the id and name of
+// Server-Sent Events, only Data is written to NDJSON streams.
+type Event struct {
+	Id   string
+	Name string
+	Data interface{}
+}
+
+// renderStream writes values received from ch until it's closed, ctx is
+// done or the server starts draining, as Server-Sent Events or NDJSON if
+// the client accepts it. The API func is expected to stop sending and
+// close ch once ctx is done.
+func (h *handler) renderStream(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, ch reflect.Value) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Streaming not supported"))
+		return
+	}
+	ndjson := strings.Contains(r.Header.Get("Accept"), ndjsonMimeType)
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonMimeType)
+	} else {
+		w.Header().Set("Content-Type", sseMimeType)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	if ch.IsNil() {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+	var drain <-chan struct{}
+	if h.life != nil {
+		drain = h.life.drain
+	}
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(heartbeat.C)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(drain)},
+	}
+	for {
+		chosen, v, ok := reflect.Select(cases)
+		var err error
+		switch chosen {
+		case 0:
+			if !ok {
+				return
+			}
+			err = writeStreamValue(w, v.Interface(), ndjson)
+		case 1, 3:
+			return
+		case 2:
+			if ndjson {
+				_, err = w.Write([]byte("\n"))
+			} else {
+				_, err = w.Write([]byte(": ping\n\n"))
+			}
+		}
+		if err != nil {
+			appgo.LoggerFromContext(ctx).WithField("error", err).Infoln("stream closed")
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamValue(w http.ResponseWriter, v interface{}, ndjson bool) error {
+	var e Event
+	switch val := v.(type) {
+	case *Event:
+		e = *val
+	case Event:
+		e = val
+	case *appgo.ApiError:
+		e = Event{Name: "error", Data: val}
+	default:
+		e = Event{Data: val}
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"data":  e.Data,
+		}).Error("Error rendering stream value")
+		return err
+	}
+	if ndjson {
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	var buf strings.Builder
+	if id := sseField(e.Id); id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	if name := sseField(e.Name); name != "" {
+		fmt.Fprintf(&buf, "event: %s\n", name)
+	}
+	fmt.Fprintf(&buf, "data: %s\n\n", data)
+	_, err = w.Write([]byte(buf.String()))
+	return err
+}
+
+// sseField strips line breaks, which would start new fields
+func sseField(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Forward secret AEAD suites only, TLS 1.3 suites are not configurable
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// ClientCertVerified tells if the request comes with a client certificate
+// signed by Conf.Tls.ClientCAFile
+func ClientCertVerified(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// RequireClientCert rejects requests without a verified client certificate
+func RequireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ClientCertVerified(r) {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// configureTls turns srv into a HTTPS server as per Conf.Tls
+func configureTls(srv *http.Server) error {
+	conf := appgo.Conf.Tls
+	cert, err := tls.LoadX509KeyPair(confPath(conf.CertFile), confPath(conf.KeyFile))
+	if err != nil {
+		return err
+	}
+	minVersion := uint16(tls.VersionTLS12)
+	if conf.MinVersion != "" {
+		v, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return errors.New("bad TLS min version: " + conf.MinVersion)
+		}
+		minVersion = v
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+	switch conf.CipherPolicy {
+	case "", "default":
+	case "modern":
+		config.CipherSuites = modernCipherSuites
+	default:
+		return errors.New("bad TLS cipher policy: " + conf.CipherPolicy)
+	}
+	if conf.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(confPath(conf.ClientCAFile))
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificate found in " + conf.ClientCAFile)
+		}
+		// Only routes that ask for it require a client certificate
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	srv.TLSConfig = config
+	if conf.DisableHttp2 {
+		// A non-nil empty map disables HTTP/2 in net/http
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	return http2.ConfigureServer(srv, &http2.Server{})
+}
+
+// newRedirectServer redirects plain HTTP requests to the HTTPS server on addr
+func newRedirectServer(port, addr string) *http.Server {
+	_, tlsPort, _ := net.SplitHostPort(addr)
+	f := func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+	return &http.Server{Addr: ":" + port, Handler: http.HandlerFunc(f)}
+}
+
+func confPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(appgo.RootDir, path)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/negroni"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"net/http"
+	"time"
+)
+
+// Longer ids from clients are replaced
+const maxRequestIdLen = 64
+
+// traceRequest tags requests with an X-Request-Id, honouring the one set by
+// clients or proxies, and starts their server span, continuing the trace
+// of the caller if there's one.
+func traceRequest(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rid := r.Header.Get(appgo.RequestIdHeaderName)
+	if rid == "" || len(rid) > maxRequestIdLen {
+		rid = randomHex(8)
+		r.Header.Set(appgo.RequestIdHeaderName, rid)
+	}
+	w.Header().Set(appgo.RequestIdHeaderName, rid)
+	ctx := trace.Extract(r.Context(), r.Header)
+	ctx, span := trace.Start(ctx, "HTTP "+r.Method, trace.KindServer,
+		attribute.String("http.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("appgo.request_id", rid))
+	defer span.End()
+	next(w, r.WithContext(appgo.WithRequestId(ctx, rid)))
+	if rw, ok := w.(negroni.ResponseWriter); ok {
+		status := rw.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// logRequest logs requests with their request and trace ids, it comes
+// after traceRequest
+func logRequest(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	fields := trace.LogFields(r.Context())
+	fields["requestId"] = appgo.RequestIdFromContext(r.Context())
+	fields["request"] = r.RequestURI
+	fields["method"] = r.Method
+	fields["remote"] = r.RemoteAddr
+	entry := log.WithFields(fields)
+	entry.Infoln("started handling request")
+	next(w, r)
+	if rw, ok := w.(negroni.ResponseWriter); ok {
+		entry = entry.WithFields(log.Fields{
+			"status":      rw.Status(),
+			"text_status": http.StatusText(rw.Status()),
+		})
+	}
+	entry.WithField("took", time.Since(start)).Infoln("completed handling request")
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/services/qiniu"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxUploadSize  = 10 << 20
+	defaultMaxUploadCount = 1
+	// Memory used by ParseMultipartForm, the rest goes to temp files
+	maxUploadMemory = 8 << 20
+	// For non-file form values, in total
+	maxFormValueSize = 1 << 20
+	sniffLen         = 512
+)
+
+var errFileTooLarge = errors.New("file too large")
+
+// UploadedFile is a file of a multipart form stored to qiniu, files are
+// deleted again if the request fails, including the API func returning an
+// error
+type UploadedFile struct {
+	Field    string
+	Filename string
+	MimeType string
+	Size     int64
+	Key      string
+	Url      string
+}
+
+// uploadSpec comes from the tags of Files__ or Uploads__:
+//
+//	form:"avatar"        only take files of the form field, all by default
+//	maxSize:"2M"         per file, K/M/G suffixes allowed, 10M by default
+//	maxCount:"3"         1 by default
+//	mime:"image/*,application/pdf"
+//	qiniuPrefix:"avatar/" prefix of qiniu keys, Uploads__ only
+//
+// Form values of Uploads__ need to come before the files, they are checked
+// before any file is stored.
+type uploadSpec struct {
+	form        string
+	maxSize     int64
+	maxCount    int
+	mimes       []string
+	stream      bool
+	qiniuPrefix string
+}
+
+func newUploadSpec(field reflect.StructField, stream bool) (*uploadSpec, error) {
+	spec := &uploadSpec{
+		form:        field.Tag.Get("form"),
+		maxSize:     defaultMaxUploadSize,
+		maxCount:    defaultMaxUploadCount,
+		stream:      stream,
+		qiniuPrefix: field.Tag.Get("qiniuPrefix"),
+	}
+	if s := field.Tag.Get("maxSize"); s != "" {
+		size, err := parseSize(s)
+		if err != nil {
+			return nil, err
+		}
+		spec.maxSize = size
+	}
+	if s := field.Tag.Get("maxCount"); s != "" {
+		count, err := strconv.Atoi(s)
+		if err != nil || count <= 0 {
+			return nil, errors.New("Bad maxCount: " + s)
+		}
+		spec.maxCount = count
+	}
+	for _, m := range strings.Split(field.Tag.Get("mime"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			spec.mimes = append(spec.mimes, m)
+		}
+	}
+	return spec, nil
+}
+
+// parse reads the multipart body of r, files are either returned as is
+// or stored to qiniu, depending on spec.stream. Non-file values are
+// passed to check once, before any file is stored.
+func (spec *uploadSpec) parse(w http.ResponseWriter, r *http.Request,
+	check func(url.Values) *appgo.ApiError) (
+	[]*multipart.FileHeader, []*UploadedFile, *appgo.ApiError) {
+	limit := spec.maxSize*int64(spec.maxCount) + maxFormValueSize
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if spec.stream {
+		uploads, aerr := spec.streamToQiniu(r, check)
+		return nil, uploads, aerr
+	}
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return nil, nil, uploadError(err)
+	}
+	var files []*multipart.FileHeader
+	for name, fhs := range r.MultipartForm.File {
+		if spec.form != "" && name != spec.form {
+			continue
+		}
+		for _, fh := range fhs {
+			if len(files) == spec.maxCount {
+				return nil, nil, tooManyFilesError(spec.maxCount)
+			}
+			if fh.Size > spec.maxSize {
+				return nil, nil, uploadError(errFileTooLarge)
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return nil, nil, uploadError(err)
+			}
+			head, _, err := sniff(f)
+			f.Close()
+			if err != nil {
+				return nil, nil, uploadError(err)
+			}
+			if aerr := spec.checkMime(head); aerr != nil {
+				return nil, nil, aerr
+			}
+			files = append(files, fh)
+		}
+	}
+	if aerr := check(url.Values(r.MultipartForm.Value)); aerr != nil {
+		return nil, nil, aerr
+	}
+	return files, nil, nil
+}
+
+// streamToQiniu stores files to qiniu while reading them from the body,
+// stored files are deleted if it fails
+func (spec *uploadSpec) streamToQiniu(r *http.Request,
+	check func(url.Values) *appgo.ApiError) ([]*UploadedFile, *appgo.ApiError) {
+	uploads, aerr := spec.readParts(r, check)
+	if aerr != nil {
+		deleteUploads(uploads)
+		return nil, aerr
+	}
+	return uploads, nil
+}
+
+func (spec *uploadSpec) readParts(r *http.Request,
+	check func(url.Values) *appgo.ApiError) ([]*UploadedFile, *appgo.ApiError) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, uploadError(err)
+	}
+	values := make(url.Values)
+	valueSize := int64(0)
+	checked := false
+	var uploads []*UploadedFile
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return uploads, uploadError(err)
+		}
+		if part.FileName() == "" {
+			if checked {
+				return uploads, appgo.NewApiErr(appgo.ECodeBadRequest,
+					"form values need to come before files")
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize-valueSize+1))
+			if err != nil {
+				return uploads, uploadError(err)
+			}
+			if valueSize += int64(len(data)); valueSize > maxFormValueSize {
+				return uploads, uploadError(errFileTooLarge)
+			}
+			values.Add(part.FormName(), string(data))
+			continue
+		}
+		if spec.form != "" && part.FormName() != spec.form {
+			continue
+		}
+		if len(uploads) == spec.maxCount {
+			return uploads, tooManyFilesError(spec.maxCount)
+		}
+		if !checked {
+			if aerr := check(values); aerr != nil {
+				return uploads, aerr
+			}
+			checked = true
+		}
+		mimeType, body, err := sniff(part)
+		if err != nil {
+			return uploads, uploadError(err)
+		}
+		if aerr := spec.checkMime(mimeType); aerr != nil {
+			return uploads, aerr
+		}
+		lr := &sizeLimitReader{body, spec.maxSize, 0}
+		key := spec.qiniuPrefix + randomHex(16) + path.Ext(part.FileName())
+		u, err := qiniu.PutStream(key, lr, mimeType)
+		if lr.n > spec.maxSize || err != nil {
+			// Parts of it may have been stored
+			uploads = append(uploads, &UploadedFile{Key: key})
+			if lr.n > spec.maxSize {
+				return uploads, uploadError(errFileTooLarge)
+			}
+			return uploads, appgo.NewApiErr(appgo.ECodeInternal, err.Error())
+		}
+		uploads = append(uploads, &UploadedFile{
+			part.FormName(), part.FileName(), mimeType, lr.n, key, u,
+		})
+	}
+	if !checked {
+		if aerr := check(values); aerr != nil {
+			return uploads, aerr
+		}
+	}
+	return uploads, nil
+}
+
+// deleteUploads removes files of failed requests from qiniu
+func deleteUploads(uploads []*UploadedFile) {
+	for _, u := range uploads {
+		if err := qiniu.Delete(u.Key); err != nil {
+			log.WithFields(log.Fields{
+				"key":   u.Key,
+				"error": err,
+			}).Errorln("failed to delete upload")
+		}
+	}
+}
+
+func (spec *uploadSpec) checkMime(mimeType string) *appgo.ApiError {
+	if len(spec.mimes) == 0 {
+		return nil
+	}
+	for _, m := range spec.mimes {
+		if m == mimeType ||
+			(strings.HasSuffix(m, "/*") && strings.HasPrefix(mimeType, m[:len(m)-1])) {
+			return nil
+		}
+	}
+	return appgo.NewApiErr(appgo.ECodeUnsupportedMediaType,
+		"unsupported file type: "+mimeType)
+}
+
+// sniff detects the type of a file by content rather than trusting the
+// client, it returns a reader of the whole content.
+func sniff(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "", nil, err
+	}
+	return mimeType, io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n > r.limit {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+func uploadError(err error) *appgo.ApiError {
+	if err == errFileTooLarge || err.Error() == "http: request body too large" {
+		return appgo.NewApiErr(appgo.ECodePayloadTooLarge, errFileTooLarge.Error())
+	}
+	return appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+}
+
+func tooManyFilesError(max int) *appgo.ApiError {
+	return appgo.NewApiErr(appgo.ECodeBadRequest,
+		"too many files, at most "+strconv.Itoa(max))
+}
+
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	switch {
+	case strings.HasSuffix(num, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(num, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(num, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("Bad maxSize: " + s)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+type testTokenStore struct{}
+
+func (testTokenStore) Validate(token auth.Token) bool { return true }
+
+type uploadApi struct {
+	META struct{} `path:"/upload"`
+}
+
+type uploadInput struct {
+	UserId__      int64 `allowAnonymous:"true"`
+	AdminUserId__ int64
+	Name          string                  `schema:"name"`
+	Files__       []*multipart.FileHeader `maxCount:"2"`
+}
+
+func (uploadApi) POST(in *uploadInput) (*uploadInput, error) {
+	return in, nil
+}
+
+func TestUploadReservedFields(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("", []interface{}{&uploadApi{}})
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("name", "tom")
+	mw.WriteField("UserId__", "42")
+	mw.WriteField("userid__", "42")
+	mw.WriteField("AdminUserId__", "42")
+	fw, _ := mw.CreateFormFile("file", "a.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload?AdminUserId__=42", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var out uploadInput
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &out), w.Body.String())
+	assert.Equal(t, "tom", out.Name)
+	assert.Equal(t, int64(appgo.AnonymousId), out.UserId__)
+	assert.Equal(t, int64(0), out.AdminUserId__)
+	assert.Len(t, out.Files__, 1)
+}
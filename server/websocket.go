@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/realtime"
+	"github.com/oxfeeefeee/appgo/redis"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = 64 << 10
+	// Browsers can't set headers on websocket requests, they get a single
+	// use ticket instead, so tokens don't end up in access logs
+	wsTicketParam  = "ticket"
+	wsTicketPath   = "/ticket"
+	wsTicketExpire = 30
+)
+
+var wsTickets = redis.NewStrings("wsticket", wsTicketExpire)
+
+// WebSocketHandler handles the connections of an endpoint added by
+// AddWebSocket. "join" and "leave" messages are handled by the server,
+// after asking CanJoin, other messages are passed to OnMessage.
+type WebSocketHandler interface {
+	// Returning an error rejects the connection
+	OnConnect(c *realtime.Client) error
+	OnMessage(c *realtime.Client, msg *realtime.Message)
+	CanJoin(c *realtime.Client, room string) bool
+	OnClose(c *realtime.Client)
+}
+
+// AddWebSocket serves authenticated websocket connections on path, the
+// token goes to the X-Appgo-Token header. Browsers POST to path+"/ticket"
+// with the header instead, and connect with the returned ticket in the
+// "ticket" query param. Connections are closed when the server drains.
+func (s *Server) AddWebSocket(path string, h WebSocketHandler) {
+	hub := realtime.DefaultHub()
+	upgrader := &websocket.Upgrader{CheckOrigin: checkOrigin}
+	f := func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(appgo.CustomTokenHeaderName)
+		if ticket := r.URL.Query().Get(wsTicketParam); token == "" && ticket != "" {
+			token, _ = wsTickets.Take(ticket)
+		}
+		user, role := auth.Token(token).Validate()
+		if user == 0 || !s.ts.Validate(auth.Token(token)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has replied with an error
+			log.WithField("error", err).Infoln("websocket upgrade failed")
+			return
+		}
+		c := hub.Register(user, role)
+		if err := h.OnConnect(c); err != nil {
+			hub.Unregister(c)
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+			conn.Close()
+			return
+		}
+		// Hijacked connections are not closed by http.Server.Shutdown
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-s.life.drain:
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+				conn.Close()
+			case <-done:
+			}
+		}()
+		go wsWrite(conn, c)
+		wsRead(conn, c, hub, h)
+		hub.Unregister(c)
+		h.OnClose(c)
+	}
+	s.HandleFunc(path, f).Methods("GET")
+	s.HandleFunc(path+wsTicketPath, s.wsTicket).Methods("POST")
+}
+
+// wsTicket hands out a ticket of the token in the header
+func (s *Server) wsTicket(w http.ResponseWriter, r *http.Request) {
+	token := auth.Token(r.Header.Get(appgo.CustomTokenHeaderName))
+	if user, _ := token.Validate(); user == 0 || !s.ts.Validate(token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ticket := randomHex(16)
+	if err := wsTickets.Set(ticket, string(token)); err != nil {
+		log.WithField("error", err).Errorln("failed to save websocket ticket")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ticket": ticket})
+}
+
+func wsRead(conn *websocket.Conn, c *realtime.Client, hub *realtime.Hub, h WebSocketHandler) {
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		hub.Touch(c)
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err,
+				websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.WithFields(log.Fields{
+					"user":  c.UserId,
+					"error": err,
+				}).Infoln("websocket closed")
+			}
+			return
+		}
+		var msg realtime.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.Send(realtime.MessageTypeError, "bad message")
+			continue
+		}
+		switch msg.Type {
+		case realtime.MessageTypeJoin:
+			if msg.Room == "" || !h.CanJoin(c, msg.Room) {
+				c.Send(realtime.MessageTypeError, "can't join "+msg.Room)
+				continue
+			}
+			hub.Join(c, msg.Room)
+		case realtime.MessageTypeLeave:
+			hub.Leave(c, msg.Room)
+		default:
+			h.OnMessage(c, &msg)
+		}
+	}
+}
+
+func wsWrite(conn *websocket.Conn, c *realtime.Client) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-c.Outbox():
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin allows requests without Origin (non-browser clients) and
+// origins allowed by Conf.Cors
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range strings.Split(appgo.Conf.Cors.AllowedOrigins, ",") {
+		if o = strings.TrimSpace(o); o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+// Package apple verifies identity tokens of Sign in with Apple.
+package apple
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo/toolkit/jwt"
+	"github.com/oxfeeefeee/appgo/trace"
+	"github.com/parnurzeal/gorequest"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	Issuer         = "https://appleid.apple.com"
+	DefaultJwksUrl = "https://appleid.apple.com/auth/keys"
+
+	defaultJwksCacheSeconds = 24 * 60 * 60
+	// Unknown kids refetch the keys at most this often, Apple rotates them
+	minJwksRefetch = time.Minute
+)
+
+var (
+	ErrBadIssuer   = errors.New("apple: bad issuer")
+	ErrBadAudience = errors.New("apple: bad audience")
+	ErrBadNonce    = errors.New("apple: bad nonce")
+	ErrNoSubject   = errors.New("apple: no subject")
+)
+
+// KeySource provides the keys identity tokens are signed with
+type KeySource interface {
+	// Keys returns the cached set unless refresh is true, fetches are
+	// traced as part of ctx
+	Keys(ctx context.Context, refresh bool) (*jwt.JWKS, error)
+}
+
+type AppInfo struct {
+	// Bundle IDs of apps and service IDs of websites, tokens must be
+	// issued to one of them
+	ClientIds []string
+	Keys      KeySource
+	// Rejects tokens without a nonce, apps issue nonces and use them once
+	// so captured tokens can't be replayed
+	RequireNonce bool
+}
+
+type UserInfo struct {
+	// Stable user id of the team
+	Sub            string
+	Email          string
+	EmailVerified  bool
+	IsPrivateEmail bool
+	// Only sent to the client on the first sign in, Apple doesn't put it in
+	// the token, so it's up to the client to pass it on
+	Nickname string
+}
+
+type claims struct {
+	jwt.StandardClaims
+	Nonce          string  `json:"nonce,omitempty"`
+	Email          string  `json:"email,omitempty"`
+	EmailVerified  boolish `json:"email_verified,omitempty"`
+	IsPrivateEmail boolish `json:"is_private_email,omitempty"`
+}
+
+// boolish decodes true and "true", Apple sends either
+type boolish bool
+
+// remoteKeys caches the JWKS of url for ttl
+type remoteKeys struct {
+	url     string
+	ttl     time.Duration
+	keys    *jwt.JWKS
+	fetched time.Time
+	lock    sync.Mutex
+}
+
+type staticKeys struct {
+	keys *jwt.JWKS
+}
+
+// RemoteKeys fetches Apple's keys from url, DefaultJwksUrl if empty, and
+// caches them for cacheSeconds, a day if 0
+func RemoteKeys(url string, cacheSeconds int) KeySource {
+	if url == "" {
+		url = DefaultJwksUrl
+	}
+	if cacheSeconds <= 0 {
+		cacheSeconds = defaultJwksCacheSeconds
+	}
+	return &remoteKeys{url: url, ttl: time.Duration(cacheSeconds) * time.Second}
+}
+
+// StaticKeys is a local stand-in for Apple's keys, e.g. in tests
+func StaticKeys(keys *jwt.JWKS) KeySource {
+	return &staticKeys{keys}
+}
+
+// VerifyIdentityToken checks the signature, issuer, audience and expiry of
+// token, and its nonce if nonce is not empty or appInfo.RequireNonce is
+// set. Clients usually put the hex sha256 of nonce in the authorization
+// request, which is matched as well as nonce itself.
+func VerifyIdentityToken(ctx context.Context, appInfo *AppInfo,
+	token, nonce string) (*UserInfo, error) {
+	var c claims
+	if _, err := jwt.Parse(token, appInfo.keyFunc(ctx), &c); err != nil {
+		return nil, err
+	}
+	if c.Issuer != Issuer {
+		return nil, ErrBadIssuer
+	}
+	if err := c.Valid(time.Now()); err != nil {
+		return nil, err
+	}
+	aud := false
+	for _, id := range appInfo.ClientIds {
+		if c.Audience.Contains(id) {
+			aud = true
+			break
+		}
+	}
+	if !aud {
+		return nil, ErrBadAudience
+	}
+	if (nonce != "" || appInfo.RequireNonce) && !nonceMatches(c.Nonce, nonce) {
+		return nil, ErrBadNonce
+	}
+	if c.Subject == "" {
+		return nil, ErrNoSubject
+	}
+	return &UserInfo{
+		Sub:            c.Subject,
+		Email:          c.Email,
+		EmailVerified:  bool(c.EmailVerified),
+		IsPrivateEmail: bool(c.IsPrivateEmail),
+	}, nil
+}
+
+func nonceMatches(claim, nonce string) bool {
+	if claim == "" || nonce == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(nonce))
+	return subtle.ConstantTimeCompare([]byte(claim), []byte(nonce)) == 1 ||
+		subtle.ConstantTimeCompare([]byte(claim), []byte(hex.EncodeToString(sum[:]))) == 1
+}
+
+// keyFunc refetches the keys once if the kid is unknown
+func (a *AppInfo) keyFunc(ctx context.Context) func(h *jwt.Header) (interface{}, error) {
+	return func(h *jwt.Header) (interface{}, error) {
+		keys, err := a.Keys.Keys(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if keys.Find(h.Kid) == nil {
+			if keys, err = a.Keys.Keys(ctx, true); err != nil {
+				return nil, err
+			}
+		}
+		return keys.KeyFunc(h)
+	}
+}
+
+func (k *remoteKeys) Keys(ctx context.Context, refresh bool) (*jwt.JWKS, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	age := time.Since(k.fetched)
+	if k.keys != nil && age < k.ttl && (!refresh || age < minJwksRefetch) {
+		return k.keys, nil
+	}
+	keys, err := k.fetch(ctx)
+	if err != nil {
+		if k.keys != nil {
+			// Stale keys are better than none
+			return k.keys, nil
+		}
+		return nil, err
+	}
+	k.keys, k.fetched = keys, time.Now()
+	return k.keys, nil
+}
+
+func (k *remoteKeys) fetch(ctx context.Context) (*jwt.JWKS, error) {
+	resp, body, errs := trace.DoBytes(ctx, gorequest.New().Get(k.url))
+	if errs != nil {
+		log.WithFields(log.Fields{
+			"errors": errs,
+			"url":    k.url,
+		}).Error("Failed to get apple keys")
+		return nil, errs[0]
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.WithFields(log.Fields{
+			"status": resp.StatusCode,
+			"url":    k.url,
+		}).Error("Failed to get apple keys")
+		return nil, errors.New("apple: failed to get keys")
+	}
+	var keys jwt.JWKS
+	if err := json.Unmarshal(body, &keys); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"body":  string(body),
+		}).Error("Failed to unmarshal apple keys")
+		return nil, err
+	}
+	return &keys, nil
+}
+
+func (k *staticKeys) Keys(ctx context.Context, refresh bool) (*jwt.JWKS, error) {
+	return k.keys, nil
+}
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = boolish(v)
+	case string:
+		*b = v == "true"
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package apple
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/oxfeeefeee/appgo/toolkit/jwt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	jwt.StandardClaims
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified string `json:"email_verified,omitempty"`
+}
+
+func TestVerifyIdentityToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	jwk, err := jwt.NewJWK("k1", jwt.RS256, &key.PublicKey)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	appInfo := &AppInfo{
+		ClientIds: []string{"com.example.app"},
+		Keys:      StaticKeys(&jwt.JWKS{[]*jwt.JWK{jwk}}),
+	}
+	claims := func() *testClaims {
+		return &testClaims{jwt.StandardClaims{
+			Issuer:    Issuer,
+			Subject:   "001234.abcd",
+			Audience:  jwt.Audience{"com.example.app"},
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}, "n1", "a@privaterelay.appleid.com", "true"}
+	}
+	sign := func(c *testClaims, kid string) string {
+		token, err := jwt.Sign(c, jwt.RS256, kid, key)
+		assert.Nil(t, err)
+		return token
+	}
+
+	info, err := VerifyIdentityToken(ctx, appInfo, sign(claims(), "k1"), "n1")
+	assert.Nil(t, err)
+	assert.Equal(t, "001234.abcd", info.Sub)
+	assert.Equal(t, "a@privaterelay.appleid.com", info.Email)
+	assert.True(t, info.EmailVerified)
+
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(claims(), "k1"), "n2")
+	assert.Equal(t, ErrBadNonce, err)
+	c := claims()
+	sum := sha256.Sum256([]byte("n1"))
+	c.Nonce = hex.EncodeToString(sum[:])
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(c, "k1"), "n1")
+	assert.Nil(t, err)
+	appInfo.RequireNonce = true
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(claims(), "k1"), "")
+	assert.Equal(t, ErrBadNonce, err)
+	c.Nonce = ""
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(c, "k1"), "")
+	assert.Equal(t, ErrBadNonce, err)
+	appInfo.RequireNonce = false
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(claims(), "k2"), "")
+	assert.Equal(t, jwt.ErrKeyNotFound, err)
+
+	c = claims()
+	c.Issuer = "https://example.com"
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(c, "k1"), "")
+	assert.Equal(t, ErrBadIssuer, err)
+	c = claims()
+	c.Audience = jwt.Audience{"com.example.other"}
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(c, "k1"), "")
+	assert.Equal(t, ErrBadAudience, err)
+	c = claims()
+	c.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	_, err = VerifyIdentityToken(ctx, appInfo, sign(c, "k1"), "")
+	assert.Equal(t, jwt.ErrExpired, err)
+}
@@ -1,8 +1,10 @@
 package leancloud
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 	"strings"
 )
@@ -79,6 +81,13 @@ func (_ Leancloud) Name() string {
 }
 
 func (l Leancloud) PushNotif(pushInfo map[appgo.Id]*appgo.PushInfo, content *appgo.PushData) {
+	l.PushNotifCtx(context.Background(), pushInfo, content)
+}
+
+// PushNotifCtx pushes in the background, the requests are traced as part
+// of ctx
+func (l Leancloud) PushNotifCtx(ctx context.Context,
+	pushInfo map[appgo.Id]*appgo.PushInfo, content *appgo.PushData) {
 	userIds := make([]string, 0, len(pushInfo))
 	for uid, _ := range pushInfo {
 		userIds = append(userIds, "\""+uid.String()+"\"")
@@ -89,11 +98,11 @@ func (l Leancloud) PushNotif(pushInfo map[appgo.Id]*appgo.PushInfo, content *app
 			end = len(userIds)
 		}
 		idstr := strings.Join(userIds[i:end], ",")
-		go l.doPushNotif(idstr, content)
+		go l.doPushNotif(ctx, idstr, content)
 	}
 }
 
-func (_ Leancloud) doPushNotif(ids string, content *appgo.PushData) {
+func (_ Leancloud) doPushNotif(ctx context.Context, ids string, content *appgo.PushData) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorln("doPushNotif paniced: ", r)
@@ -101,7 +110,7 @@ func (_ Leancloud) doPushNotif(ids string, content *appgo.PushData) {
 	}()
 	cql := "select * from _Installation where userId in ( " + ids + " )"
 	pl := buildPayload(content)
-	request(&LeancloudPush{
+	request(ctx, &LeancloudPush{
 		ExpirationInterval: expiration,
 		Prod:               prod,
 		Data:               pl,
@@ -120,7 +129,7 @@ func (_ Leancloud) doPushToChannel(channel string, content *appgo.PushData) {
 		}
 	}()
 	pl := buildPayload(content)
-	request(&LeancloudPush{
+	request(context.Background(), &LeancloudPush{
 		ExpirationInterval: expiration,
 		Prod:               prod,
 		Data:               pl,
@@ -151,13 +160,13 @@ func buildPayload(content *appgo.PushData) *IosAndroidData {
 	}
 }
 
-func request(p *LeancloudPush) {
-	_, ret, errs := gorequest.New().SetDebug(true).
+func request(ctx context.Context, p *LeancloudPush) {
+	req := gorequest.New().SetDebug(true).
 		Post(sendUrl).
 		Set("X-LC-Id", appId).
 		Set("X-LC-Key", appKey).
-		SendStruct(p).
-		End()
+		SendStruct(p)
+	_, ret, errs := trace.Do(ctx, req)
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -0,0 +1,473 @@
+// Package oidc logs users in with the authorization code flow of OpenID
+// Connect providers, with PKCE. OAuth2 providers without ID tokens work
+// too if their endpoints are configured and they have a user info endpoint.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+	"github.com/oxfeeefeee/appgo/toolkit/jwt"
+	"github.com/oxfeeefeee/appgo/trace"
+	"github.com/parnurzeal/gorequest"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+
+	defaultCacheSeconds = 24 * 60 * 60
+	// Unknown kids refetch the keys at most this often
+	minKeysRefetch = time.Minute
+)
+
+var (
+	ErrUnknownProvider = errors.New("oidc: unknown provider")
+	ErrBadIssuer       = errors.New("oidc: bad issuer")
+	ErrBadAudience     = errors.New("oidc: bad audience")
+	ErrBadNonce        = errors.New("oidc: bad nonce")
+	ErrNoSubject       = errors.New("oidc: no subject")
+
+	providers     = make(map[string]*Provider)
+	providersLock sync.RWMutex
+
+	encoding = base64.RawURLEncoding
+)
+
+type Config struct {
+	// Identities are keyed by Name and subject, don't rename providers
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	// "openid" is added if Issuer is set
+	Scopes []string
+	// Override the endpoints found by discovery
+	AuthUrl     string
+	TokenUrl    string
+	UserInfoUrl string
+	JwksUrl     string
+	// Claims UserInfo fields are taken from, standard claims by default
+	Claims ClaimMap
+	// Seconds discovery and keys are cached, a day if 0
+	CacheSeconds int
+}
+
+type ClaimMap struct {
+	Subject       string
+	Email         string
+	EmailVerified string
+	Nickname      string
+	Portrait      string
+}
+
+type UserInfo struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Nickname      string
+	Portrait      string
+	// Claims of the ID token, overridden by those of the user info endpoint
+	Claims map[string]interface{}
+}
+
+type Provider struct {
+	conf        Config
+	ttl         time.Duration
+	meta        *metadata
+	metaFetched time.Time
+	keys        *jwt.JWKS
+	keysFetched time.Time
+	lock        sync.Mutex
+}
+
+type metadata struct {
+	Issuer      string `json:"issuer"`
+	AuthUrl     string `json:"authorization_endpoint"`
+	TokenUrl    string `json:"token_endpoint"`
+	UserInfoUrl string `json:"userinfo_endpoint"`
+	JwksUrl     string `json:"jwks_uri"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	ErrorDesc   string `json:"error_description"`
+}
+
+// idClaims keeps all claims besides the ones that are checked
+type idClaims struct {
+	jwt.StandardClaims
+	Nonce string `json:"nonce"`
+	all   map[string]interface{}
+}
+
+var defaultClaims = ClaimMap{
+	Subject:       "sub",
+	Email:         "email",
+	EmailVerified: "email_verified",
+	Nickname:      "name",
+	Portrait:      "picture",
+}
+
+// Register adds a provider, it fails if the name is taken or conf lacks
+// what the code flow needs. Endpoints are discovered on first use.
+func Register(conf *Config) (*Provider, error) {
+	if conf.Name == "" || conf.ClientId == "" || conf.RedirectUrl == "" {
+		return nil, errors.New("oidc: name, client id and redirect url are required")
+	}
+	if conf.Issuer == "" && (conf.AuthUrl == "" || conf.TokenUrl == "" || conf.UserInfoUrl == "") {
+		return nil, errors.New("oidc: issuer or endpoints are required: " + conf.Name)
+	}
+	p := &Provider{conf: *conf}
+	p.conf.Claims = withDefaults(conf.Claims)
+	if p.conf.Issuer != "" && !contains(p.conf.Scopes, "openid") {
+		p.conf.Scopes = append([]string{"openid"}, p.conf.Scopes...)
+	}
+	cacheSeconds := conf.CacheSeconds
+	if cacheSeconds <= 0 {
+		cacheSeconds = defaultCacheSeconds
+	}
+	p.ttl = time.Duration(cacheSeconds) * time.Second
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, ok := providers[conf.Name]; ok {
+		return nil, errors.New("oidc: provider already registered: " + conf.Name)
+	}
+	providers[conf.Name] = p
+	return p, nil
+}
+
+// Get returns the provider of name, nil if not registered
+func Get(name string) *Provider {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	return providers[name]
+}
+
+// NewState returns random state, nonce and PKCE code verifier of a login
+func NewState() (state, nonce, verifier string, err error) {
+	var b []byte
+	if b, err = crypto.RandBytes(32 * 3); err != nil {
+		return
+	}
+	return encoding.EncodeToString(b[:32]), encoding.EncodeToString(b[32:64]),
+		encoding.EncodeToString(b[64:]), nil
+}
+
+func (p *Provider) Name() string {
+	return p.conf.Name
+}
+
+// AuthCodeUrl returns where to send users to log in, the provider redirects
+// them to the redirect URL with state and a code for Exchange.
+func (p *Provider) AuthCodeUrl(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.conf.ClientId},
+		"redirect_uri":          {p.conf.RedirectUrl},
+		"scope":                 {strings.Join(p.conf.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {encoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.conf.Issuer != "" {
+		q.Set("nonce", nonce)
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthUrl, "?") {
+		sep = "&"
+	}
+	return meta.AuthUrl + sep + q.Encode(), nil
+}
+
+// Exchange redeems code, verifies the ID token if there's one and reads
+// the user info endpoint if there's one, requests are traced as part of ctx
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*UserInfo, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := p.redeem(ctx, meta, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	// ID tokens of OAuth2 providers can't be verified without an issuer
+	claims := make(map[string]interface{})
+	if p.conf.Issuer != "" {
+		if tr.IdToken == "" {
+			return nil, errors.New("oidc: no id token")
+		}
+		if claims, err = p.verifyIdToken(ctx, meta, tr.IdToken, nonce); err != nil {
+			return nil, err
+		}
+	}
+	if meta.UserInfoUrl != "" && tr.AccessToken != "" {
+		uclaims, err := p.userInfo(ctx, meta, tr.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		// The user info must be of the user of the ID token
+		if sub, ok := claims["sub"]; ok && fmt.Sprint(uclaims["sub"]) != fmt.Sprint(sub) {
+			return nil, errors.New("oidc: user info of another subject")
+		}
+		for k, v := range uclaims {
+			claims[k] = v
+		}
+	}
+	return p.mapClaims(claims)
+}
+
+func (p *Provider) redeem(ctx context.Context, meta *metadata, code, verifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.conf.RedirectUrl},
+		"client_id":     {p.conf.ClientId},
+		"code_verifier": {verifier},
+	}
+	if p.conf.ClientSecret != "" {
+		form.Set("client_secret", p.conf.ClientSecret)
+	}
+	req := gorequest.New().Post(meta.TokenUrl).Type("form").
+		Set("Accept", "application/json").Send(form.Encode())
+	var tr tokenResponse
+	if err := p.getJson(ctx, req, "token", &tr); err != nil {
+		return nil, err
+	}
+	if tr.Error != "" {
+		return nil, fmt.Errorf("oidc: %s: %s", tr.Error, tr.ErrorDesc)
+	}
+	return &tr, nil
+}
+
+func (p *Provider) verifyIdToken(ctx context.Context, meta *metadata,
+	token, nonce string) (map[string]interface{}, error) {
+	var c idClaims
+	if _, err := jwt.Parse(token, p.keyFunc(ctx), &c); err != nil {
+		return nil, err
+	}
+	if c.Issuer != meta.Issuer {
+		return nil, ErrBadIssuer
+	}
+	if !c.Audience.Contains(p.conf.ClientId) {
+		return nil, ErrBadAudience
+	}
+	if err := c.Valid(time.Now()); err != nil {
+		return nil, err
+	}
+	if c.Nonce != nonce {
+		return nil, ErrBadNonce
+	}
+	return c.all, nil
+}
+
+func (p *Provider) userInfo(ctx context.Context, meta *metadata,
+	accessToken string) (map[string]interface{}, error) {
+	req := gorequest.New().Get(meta.UserInfoUrl).
+		Set("Authorization", "Bearer "+accessToken).Set("Accept", "application/json")
+	var claims map[string]interface{}
+	if err := p.getJson(ctx, req, "user info", &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (p *Provider) mapClaims(claims map[string]interface{}) (*UserInfo, error) {
+	m := &p.conf.Claims
+	info := &UserInfo{
+		Provider: p.conf.Name,
+		Subject:  claimString(claims, m.Subject),
+		Email:    claimString(claims, m.Email),
+		Nickname: claimString(claims, m.Nickname),
+		Portrait: claimString(claims, m.Portrait),
+		Claims:   claims,
+	}
+	if info.Subject == "" {
+		return nil, ErrNoSubject
+	}
+	switch v := claims[m.EmailVerified].(type) {
+	case bool:
+		info.EmailVerified = v
+	case string:
+		info.EmailVerified = v == "true"
+	}
+	return info, nil
+}
+
+// metadata is discovered unless all endpoints are configured
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	c := &p.conf
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.meta != nil && time.Since(p.metaFetched) < p.ttl {
+		return p.meta, nil
+	}
+	meta := &metadata{}
+	if c.Issuer != "" && (c.AuthUrl == "" || c.TokenUrl == "" || c.JwksUrl == "") {
+		req := gorequest.New().Get(strings.TrimSuffix(c.Issuer, "/") + discoveryPath)
+		if err := p.getJson(ctx, req, "discovery", meta); err != nil {
+			if p.meta != nil {
+				// Stale metadata is better than none
+				return p.meta, nil
+			}
+			return nil, err
+		}
+		if meta.Issuer != c.Issuer {
+			return nil, ErrBadIssuer
+		}
+	}
+	meta.Issuer = c.Issuer
+	for _, o := range []struct {
+		to   *string
+		conf string
+	}{
+		{&meta.AuthUrl, c.AuthUrl},
+		{&meta.TokenUrl, c.TokenUrl},
+		{&meta.UserInfoUrl, c.UserInfoUrl},
+		{&meta.JwksUrl, c.JwksUrl},
+	} {
+		if o.conf != "" {
+			*o.to = o.conf
+		}
+	}
+	p.meta, p.metaFetched = meta, time.Now()
+	return meta, nil
+}
+
+// keyFunc refetches the keys once if the kid is unknown
+func (p *Provider) keyFunc(ctx context.Context) func(h *jwt.Header) (interface{}, error) {
+	return func(h *jwt.Header) (interface{}, error) {
+		keys, err := p.jwks(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if keys.Find(h.Kid) == nil {
+			if keys, err = p.jwks(ctx, true); err != nil {
+				return nil, err
+			}
+		}
+		return keys.KeyFunc(h)
+	}
+}
+
+func (p *Provider) jwks(ctx context.Context, refresh bool) (*jwt.JWKS, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	age := time.Since(p.keysFetched)
+	if p.keys != nil && age < p.ttl && (!refresh || age < minKeysRefetch) {
+		return p.keys, nil
+	}
+	var keys jwt.JWKS
+	if err := p.getJson(ctx, gorequest.New().Get(meta.JwksUrl), "keys", &keys); err != nil {
+		if p.keys != nil {
+			return p.keys, nil
+		}
+		return nil, err
+	}
+	p.keys, p.keysFetched = &keys, time.Now()
+	return p.keys, nil
+}
+
+func (p *Provider) getJson(ctx context.Context, req *gorequest.SuperAgent,
+	what string, v interface{}) error {
+	resp, body, errs := trace.DoBytes(ctx, req)
+	if errs != nil {
+		log.WithFields(log.Fields{
+			"provider": p.conf.Name,
+			"errors":   errs,
+		}).Error("Failed to get oidc " + what)
+		return errs[0]
+	}
+	// Token errors come with status 400 and a JSON body
+	if resp.StatusCode != http.StatusOK &&
+		!(what == "token" && resp.StatusCode == http.StatusBadRequest) {
+		log.WithFields(log.Fields{
+			"provider": p.conf.Name,
+			"status":   resp.StatusCode,
+			"body":     string(body),
+		}).Error("Failed to get oidc " + what)
+		return fmt.Errorf("oidc: failed to get %s, status %d", what, resp.StatusCode)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(body)))
+	// Numeric subjects stay exact
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		log.WithFields(log.Fields{
+			"provider": p.conf.Name,
+			"error":    err,
+			"body":     string(body),
+		}).Error("Failed to unmarshal oidc " + what)
+		return err
+	}
+	return nil
+}
+
+func (c *idClaims) UnmarshalJSON(data []byte) error {
+	type plain idClaims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(&c.all)
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func withDefaults(m ClaimMap) ClaimMap {
+	for _, f := range []struct {
+		v   *string
+		def string
+	}{
+		{&m.Subject, defaultClaims.Subject},
+		{&m.Email, defaultClaims.Email},
+		{&m.EmailVerified, defaultClaims.EmailVerified},
+		{&m.Nickname, defaultClaims.Nickname},
+		{&m.Portrait, defaultClaims.Portrait},
+	} {
+		if *f.v == "" {
+			*f.v = f.def
+		}
+	}
+	return m
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/oxfeeefeee/appgo/toolkit/jwt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	jwt.StandardClaims
+	Nonce string `json:"nonce"`
+	Email string `json:"email"`
+}
+
+func TestCodeFlow(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	jwk, err := jwt.NewJWK("k1", jwt.RS256, &key.PublicKey)
+	assert.Nil(t, err)
+
+	var issuer, nonce, challenge string
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	issuer = srv.URL
+	writeJson := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, &metadata{issuer, issuer + "/auth", issuer + "/token",
+			issuer + "/userinfo", issuer + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, &jwt.JWKS{[]*jwt.JWK{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "c1" || encoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJson(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idToken, _ := jwt.Sign(&testClaims{jwt.StandardClaims{
+			Issuer:    issuer,
+			Subject:   "u1",
+			Audience:  jwt.Audience{"client"},
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}, nonce, "a@example.com"}, jwt.RS256, "k1", key)
+		writeJson(w, map[string]string{"access_token": "at", "id_token": idToken})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer at", r.Header.Get("Authorization"))
+		writeJson(w, map[string]interface{}{"sub": "u1", "nick": "Alice", "email_verified": true})
+	})
+
+	p, err := Register(&Config{
+		Name:        "test",
+		Issuer:      issuer,
+		ClientId:    "client",
+		RedirectUrl: "https://app.example.com/cb",
+		Claims:      ClaimMap{Nickname: "nick"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, p, Get("test"))
+	_, err = Register(&Config{Name: "test", Issuer: issuer,
+		ClientId: "client", RedirectUrl: "https://app.example.com/cb"})
+	assert.NotNil(t, err)
+
+	ctx := context.Background()
+	state, n, verifier, err := NewState()
+	assert.Nil(t, err)
+	authUrl, err := p.AuthCodeUrl(ctx, state, n, verifier)
+	assert.Nil(t, err)
+	u, err := url.Parse(authUrl)
+	assert.Nil(t, err)
+	q := u.Query()
+	assert.Equal(t, issuer+"/auth", "http://"+u.Host+u.Path)
+	assert.Equal(t, "openid", q.Get("scope"))
+	assert.Equal(t, state, q.Get("state"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	nonce, challenge = q.Get("nonce"), q.Get("code_challenge")
+
+	info, err := p.Exchange(ctx, "c1", verifier, n)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", info.Provider)
+	assert.Equal(t, "u1", info.Subject)
+	assert.Equal(t, "a@example.com", info.Email)
+	assert.True(t, info.EmailVerified)
+	assert.Equal(t, "Alice", info.Nickname)
+
+	_, err = p.Exchange(ctx, "c1", verifier, "other")
+	assert.Equal(t, ErrBadNonce, err)
+	_, err = p.Exchange(ctx, "c1", "bad verifier", n)
+	assert.NotNil(t, err)
+}
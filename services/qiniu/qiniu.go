@@ -77,6 +77,23 @@ func PutFile(key string, r io.Reader, size int64) (string, error) {
 	}
 }
 
+// PutStream uploads r of unknown size, it returns the url of key
+func PutStream(key string, r io.Reader, mimeType string) (string, error) {
+	policy := putPolicy
+	policy.Scope = bucketName + ":" + key
+	token := policy.Token(nil)
+	extra := &qnio.PutExtra{MimeType: mimeType}
+	if err := qnio.Put(nil, nil, token, key, r, extra); err != nil {
+		return "", err
+	}
+	return makeBaseUrl(key), nil
+}
+
+// Delete removes key from the bucket
+func Delete(key string) error {
+	return rs.New(nil).Delete(nil, bucketName, key)
+}
+
 func FetchToken(url, key string) (string, string, string) {
 	encodedUrl := base64.URLEncoding.EncodeToString([]byte(url))
 	encodedTo := base64.URLEncoding.EncodeToString([]byte(bucketName + ":" + key))
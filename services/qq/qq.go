@@ -1,8 +1,10 @@
 package qq
 
 import (
+	"context"
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 	"net/url"
 )
@@ -20,18 +22,30 @@ type AppInfo struct {
 	AppId string
 }
 
+// TokenInfo tells whose token it is, unlike the openid sent along with
+// tokens by clients
+type TokenInfo struct {
+	ClientId string `json:"client_id"`
+	OpenId   string `json:"openid"`
+}
+
 type apiError struct {
 	ErrCode int    `json:"ret"`
 	ErrMsg  string `json:"msg"`
 }
 
 func GetUserInfo(appInfo *AppInfo, id, token string) *UserInfo {
+	return GetUserInfoCtx(context.Background(), appInfo, id, token)
+}
+
+// GetUserInfoCtx is GetUserInfo traced as part of ctx
+func GetUserInfoCtx(ctx context.Context, appInfo *AppInfo, id, token string) *UserInfo {
 	var uinfo struct {
 		UserInfo
 		apiError
 	}
 	url := userInfoUrl(appInfo.AppId, id, token)
-	_, body, errs := gorequest.New().Get(url).End()
+	_, body, errs := trace.Do(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -56,6 +70,38 @@ func GetUserInfo(appInfo *AppInfo, id, token string) *UserInfo {
 	return &uinfo.UserInfo
 }
 
+// GetOpenIdCtx asks qq whose token it is, traced as part of ctx
+func GetOpenIdCtx(ctx context.Context, token string) *TokenInfo {
+	var info struct {
+		TokenInfo
+		ErrCode int    `json:"error"`
+		ErrMsg  string `json:"error_description"`
+	}
+	url := openIdUrl(token)
+	_, body, errs := trace.Do(ctx, gorequest.New().Get(url))
+	if errs != nil {
+		log.WithFields(log.Fields{
+			"errors": errs,
+			"url":    url,
+		}).Error("Failed to get openid")
+		return nil
+	}
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"body":  string(body),
+		}).Error("Failed to unmarshal openid")
+		return nil
+	} else if info.ErrCode != 0 || info.OpenId == "" {
+		log.WithFields(log.Fields{
+			"errCode": info.ErrCode,
+			"errMsg":  info.ErrMsg,
+		}).Error("GetOpenId api returns error")
+		return nil
+	}
+	return &info.TokenInfo
+}
+
 func userInfoUrl(appid, id, token string) string {
 	var u url.URL
 	u.Scheme = "https"
@@ -69,3 +115,15 @@ func userInfoUrl(appid, id, token string) string {
 	u.RawQuery = q.Encode()
 	return u.String()
 }
+
+func openIdUrl(token string) string {
+	var u url.URL
+	u.Scheme = "https"
+	u.Host = "graph.qq.com"
+	u.Path = "oauth2.0/me"
+	q := u.Query()
+	q.Set("access_token", token)
+	q.Set("fmt", "json")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -1,12 +1,14 @@
 package umeng
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
 	"github.com/oxfeeefeee/appgo/toolkit/crypto"
 	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 	"strings"
 	"time"
@@ -86,6 +88,13 @@ func (_ Umeng) Name() string {
 }
 
 func (u Umeng) PushNotif(pushInfo map[appgo.Id]*appgo.PushInfo, content *appgo.PushData) {
+	u.PushNotifCtx(context.Background(), pushInfo, content)
+}
+
+// PushNotifCtx pushes in the background, the requests are traced as part
+// of ctx
+func (u Umeng) PushNotifCtx(ctx context.Context,
+	pushInfo map[appgo.Id]*appgo.PushInfo, content *appgo.PushData) {
 	iosTokens := make([]string, 0, len(pushInfo))
 	androidTokens := make([]string, 0, len(pushInfo))
 	for _, pi := range pushInfo {
@@ -103,7 +112,7 @@ func (u Umeng) PushNotif(pushInfo map[appgo.Id]*appgo.PushInfo, content *appgo.P
 			if end > len(iosTokens) {
 				end = len(iosTokens)
 			}
-			go u.doPushNotif(iosTokens[i:end], iosPayload, iosAppKey, iosSecret)
+			go u.doPushNotif(ctx, iosTokens[i:end], iosPayload, iosAppKey, iosSecret)
 		}
 	}
 	if androidPayload != nil && len(androidTokens) > 0 {
@@ -112,12 +121,12 @@ func (u Umeng) PushNotif(pushInfo map[appgo.Id]*appgo.PushInfo, content *appgo.P
 			if end > len(androidTokens) {
 				end = len(androidTokens)
 			}
-			go u.doPushNotif(androidTokens[i:end], androidPayload, androidAppKey, androidSecret)
+			go u.doPushNotif(ctx, androidTokens[i:end], androidPayload, androidAppKey, androidSecret)
 		}
 	}
 }
 
-func (_ Umeng) doPushNotif(tokens []string, payload interface{}, appkey, secret string) {
+func (_ Umeng) doPushNotif(ctx context.Context, tokens []string, payload interface{}, appkey, secret string) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorln("doPushNotif paniced: ", r)
@@ -133,7 +142,7 @@ func (_ Umeng) doPushNotif(tokens []string, payload interface{}, appkey, secret
 		return
 	}
 	sig := sign(string(jdata), secret)
-	request(string(jdata), sig)
+	request(ctx, string(jdata), sig)
 }
 
 func buildIosPayload(content *appgo.PushData) interface{} {
@@ -187,12 +196,12 @@ func getAllData(appkey, tokens string, payload interface{}) *Data {
 	}
 }
 
-func request(body, sig string) {
+func request(ctx context.Context, body, sig string) {
 	url := sendUrl + "?sign=" + sig
 	req := gorequest.New().Post(url).Type("json")
 	req.RawString = body
 	req.BounceToRawString = true
-	_, ret, errs := req.EndBytes()
+	_, ret, errs := trace.DoBytes(ctx, req)
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -1,12 +1,16 @@
 package weibo
 
 import (
+	"context"
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 	"net/url"
 )
 
+const tokenInfoUrl = "https://api.weibo.com/oauth2/get_token_info"
+
 type UserInfo struct {
 	Id    string `json:"idstr"`
 	Name  string `json:"name"`
@@ -30,18 +34,32 @@ type AccessTokenResult struct {
 	Id          string `json:"uid"`
 }
 
+// TokenInfo tells whose token it is, unlike the uid returned along with
+// tokens by clients
+type TokenInfo struct {
+	Uid    int64  `json:"uid"`
+	AppKey string `json:"appkey"`
+	// Seconds
+	ExpireIn int64 `json:"expire_in"`
+}
+
 type apiError struct {
 	ErrCode int    `json:"error_code"`
 	ErrMsg  string `json:"error"`
 }
 
 func GetAccessToken(params *AccessTokenParams) *AccessTokenResult {
+	return GetAccessTokenCtx(context.Background(), params)
+}
+
+// GetAccessTokenCtx is GetAccessToken traced as part of ctx
+func GetAccessTokenCtx(ctx context.Context, params *AccessTokenParams) *AccessTokenResult {
 	var result struct {
 		AccessTokenResult
 		apiError
 	}
 	url := accessTokenUrl(params)
-	_, body, errs := gorequest.New().Get(url).End()
+	_, body, errs := trace.Do(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -66,12 +84,17 @@ func GetAccessToken(params *AccessTokenParams) *AccessTokenResult {
 }
 
 func GetUserInfo(id, token string) *UserInfo {
+	return GetUserInfoCtx(context.Background(), id, token)
+}
+
+// GetUserInfoCtx is GetUserInfo traced as part of ctx
+func GetUserInfoCtx(ctx context.Context, id, token string) *UserInfo {
 	var uinfo struct {
 		UserInfo
 		apiError
 	}
 	url := userInfoUrl(id, token)
-	_, body, errs := gorequest.New().Get(url).End()
+	_, body, errs := trace.Do(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -95,6 +118,38 @@ func GetUserInfo(id, token string) *UserInfo {
 	return &uinfo.UserInfo
 }
 
+// GetTokenInfoCtx asks weibo about token, traced as part of ctx
+func GetTokenInfoCtx(ctx context.Context, token string) *TokenInfo {
+	var info struct {
+		TokenInfo
+		apiError
+	}
+	req := gorequest.New().Post(tokenInfoUrl).Type("form").
+		Send(url.Values{"access_token": {token}}.Encode())
+	_, body, errs := trace.Do(ctx, req)
+	if errs != nil {
+		log.WithFields(log.Fields{
+			"errors": errs,
+			"url":    tokenInfoUrl,
+		}).Error("Failed to get token info")
+		return nil
+	}
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"body":  string(body),
+		}).Error("Failed to unmarshal token info")
+		return nil
+	} else if info.ErrCode != 0 || info.Uid == 0 {
+		log.WithFields(log.Fields{
+			"errCode": info.ErrCode,
+			"errMsg":  info.ErrMsg,
+		}).Error("GetTokenInfo api returns error")
+		return nil
+	}
+	return &info.TokenInfo
+}
+
 func accessTokenUrl(params *AccessTokenParams) string {
 	var u url.URL
 	u.Scheme = "https"
@@ -1,6 +1,7 @@
 package jssdk
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -36,12 +37,17 @@ func Init(kvs appgo.KvStore) {
 }
 
 func GetConfig(url string) *WxConfig {
+	return GetConfigCtx(context.Background(), url)
+}
+
+// GetConfigCtx is GetConfig traced as part of ctx
+func GetConfigCtx(ctx context.Context, url string) *WxConfig {
 	config := &WxConfig{
 		AppId:     appId,
 		Timestamp: time.Now().Unix(),
 		NonceStr:  crypto.RandNumStr(15),
 	}
-	ticket := getTicket()
+	ticket := getTicket(ctx)
 	sign(config, ticket, url)
 	return config
 }
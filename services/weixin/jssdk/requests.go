@@ -1,10 +1,12 @@
 package jssdk
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 	"time"
 )
@@ -53,42 +55,42 @@ func readData(key string) *tokenTicketData {
 	return &td
 }
 
-func getToken() string {
+func getToken(ctx context.Context) string {
 	token := readData(tokenStoreKey)
 	if token == nil {
-		return doGetToken()
+		return doGetToken(ctx)
 	}
 	now := time.Now()
 	if token.ExpiresAt.Before(now) {
-		return doGetToken()
+		return doGetToken(ctx)
 	} else if token.RefreshAt.Before(now) {
-		go doGetToken()
+		go doGetToken(ctx)
 	}
 	return token.TokenTicket
 }
 
-func getTicket() string {
+func getTicket(ctx context.Context) string {
 	ticket := readData(ticketStoreKey)
 	if ticket == nil {
-		return doGetTicket()
+		return doGetTicket(ctx)
 	}
 	now := time.Now()
 	if ticket.ExpiresAt.Before(now) {
-		return doGetTicket()
+		return doGetTicket(ctx)
 	} else if ticket.RefreshAt.Before(now) {
-		go doGetTicket()
+		go doGetTicket(ctx)
 	}
 	return ticket.TokenTicket
 }
 
-func doGetToken() string {
+func doGetToken(ctx context.Context) string {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorln("doGetToken paniced: ", r)
 		}
 	}()
 	url := fmt.Sprintf(accessTokenUrl, appId, appSecret)
-	_, data, errs := gorequest.New().Get(url).EndBytes()
+	_, data, errs := trace.DoBytes(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -119,15 +121,15 @@ func doGetToken() string {
 	return token.TokenTicket
 }
 
-func doGetTicket() string {
+func doGetTicket(ctx context.Context) string {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorln("doGetTicket paniced: ", r)
 		}
 	}()
-	token := getToken()
+	token := getToken(ctx)
 	url := fmt.Sprintf(ticketUrl, token)
-	_, data, errs := gorequest.New().Get(url).EndBytes()
+	_, data, errs := trace.DoBytes(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
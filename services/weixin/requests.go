@@ -1,8 +1,10 @@
 package weixin
 
 import (
+	"context"
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 	"net/url"
 )
@@ -41,12 +43,17 @@ type apiError struct {
 }
 
 func GetAccessToken(params *AccessTokenParams) *AccessTokenResult {
+	return GetAccessTokenCtx(context.Background(), params)
+}
+
+// GetAccessTokenCtx is GetAccessToken traced as part of ctx
+func GetAccessTokenCtx(ctx context.Context, params *AccessTokenParams) *AccessTokenResult {
 	var result struct {
 		AccessTokenResult
 		apiError
 	}
 	url := accessTokenUrl(params)
-	_, body, errs := gorequest.New().Get(url).EndBytes()
+	_, body, errs := trace.DoBytes(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -71,12 +78,17 @@ func GetAccessToken(params *AccessTokenParams) *AccessTokenResult {
 }
 
 func GetUserInfo(id, token string) *UserInfo {
+	return GetUserInfoCtx(context.Background(), id, token)
+}
+
+// GetUserInfoCtx is GetUserInfo traced as part of ctx
+func GetUserInfoCtx(ctx context.Context, id, token string) *UserInfo {
 	var uinfo struct {
 		UserInfo
 		apiError
 	}
 	url := userInfoUrl(id, token)
-	_, body, errs := gorequest.New().Get(url).EndBytes()
+	_, body, errs := trace.DoBytes(ctx, gorequest.New().Get(url))
 	if errs != nil {
 		log.WithFields(log.Fields{
 			"errors": errs,
@@ -38,6 +38,7 @@ func RandBytes(c int) ([]byte, error) {
 	}
 }
 
+// Deprecated: a single SHA-512 is too fast for passwords, use HashPassword
 func SaltedHash(salt []byte, password string) [64]byte {
 	pw := append(salt, []byte(password)...)
 	return sha512.Sum512(pw)
@@ -0,0 +1,179 @@
+package crypto
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+const (
+	PasswordArgon2id = "argon2id"
+	PasswordBcrypt   = "bcrypt"
+	PasswordScrypt   = "scrypt"
+
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+var ErrBadPasswordHash = errors.New("crypto: bad password hash")
+
+var b64 = base64.RawStdEncoding
+
+// PasswordParams selects the KDF of new hashes, encoded hashes record their
+// own algorithm and parameters:
+//
+//	$argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+//	$2a$10$<bcrypt salt and key>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<key>
+type PasswordParams struct {
+	Alg string
+	// argon2id, memory in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	// bcrypt
+	Cost int
+	// scrypt, N is 1<<LogN
+	LogN uint8
+	R    int
+	P    int
+}
+
+var DefaultPasswordParams = PasswordParams{
+	Alg:     PasswordArgon2id,
+	Memory:  64 * 1024,
+	Time:    1,
+	Threads: 4,
+	Cost:    bcrypt.DefaultCost,
+	LogN:    15,
+	R:       8,
+	P:       1,
+}
+
+// HashPassword returns the encoded hash of password
+func HashPassword(password string, params *PasswordParams) (string, error) {
+	if params.Alg == PasswordBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), params.Cost)
+		return string(hash), err
+	}
+	salt, err := RandBytes(passwordSaltLen)
+	if err != nil {
+		return "", err
+	}
+	switch params.Alg {
+	case PasswordArgon2id:
+		key := argon2.IDKey([]byte(password), salt,
+			params.Time, params.Memory, params.Threads, passwordKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			params.Memory, params.Time, params.Threads,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case PasswordScrypt:
+		key, err := scrypt.Key([]byte(password), salt,
+			1<<params.LogN, params.R, params.P, passwordKeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+			params.LogN, params.R, params.P,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	}
+	return "", errors.New("crypto: unknown password algorithm " + params.Alg)
+}
+
+// VerifyPassword checks password against an encoded hash, errors are
+// only returned for malformed hashes.
+func VerifyPassword(encoded, password string) (bool, error) {
+	if strings.HasPrefix(encoded, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	p, salt, key, err := decodePasswordHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	var derived []byte
+	switch p.Alg {
+	case PasswordArgon2id:
+		derived = argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	case PasswordScrypt:
+		if derived, err = scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, len(key)); err != nil {
+			return false, err
+		}
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// NeedsRehash tells if encoded wasn't made with the algorithm and parameters
+// of params, so it should be replaced on the next successful login.
+func NeedsRehash(encoded string, params *PasswordParams) bool {
+	if strings.HasPrefix(encoded, "$2") {
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || params.Alg != PasswordBcrypt || cost != params.Cost
+	}
+	p, _, _, err := decodePasswordHash(encoded)
+	if err != nil || p.Alg != params.Alg {
+		return true
+	}
+	switch p.Alg {
+	case PasswordArgon2id:
+		return p.Memory != params.Memory || p.Time != params.Time || p.Threads != params.Threads
+	case PasswordScrypt:
+		return p.LogN != params.LogN || p.R != params.R || p.P != params.P
+	}
+	return true
+}
+
+// VerifyLegacyPassword checks password against a SaltedHash
+func VerifyLegacyPassword(salt, hash []byte, password string) bool {
+	// SaltedHash appends to salt, which may share its array with the caller
+	pw := append(append([]byte(nil), salt...), password...)
+	sum := sha512.Sum512(pw)
+	return subtle.ConstantTimeCompare(sum[:], hash) == 1
+}
+
+func decodePasswordHash(encoded string) (*PasswordParams, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	p := &PasswordParams{}
+	var n int
+	var err error
+	switch {
+	case len(parts) == 6 && parts[1] == PasswordArgon2id:
+		p.Alg = PasswordArgon2id
+		var ver int
+		if _, err = fmt.Sscanf(parts[2], "v=%d", &ver); err != nil || ver != argon2.Version {
+			return nil, nil, nil, ErrBadPasswordHash
+		}
+		n, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+		if p.Time == 0 || p.Threads == 0 {
+			return nil, nil, nil, ErrBadPasswordHash
+		}
+		parts = parts[4:]
+	case len(parts) == 5 && parts[1] == PasswordScrypt:
+		p.Alg = PasswordScrypt
+		n, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P)
+		parts = parts[3:]
+	default:
+		return nil, nil, nil, ErrBadPasswordHash
+	}
+	if err != nil || n != 3 {
+		return nil, nil, nil, ErrBadPasswordHash
+	}
+	salt, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, nil, ErrBadPasswordHash
+	}
+	key, err := b64.DecodeString(parts[1])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrBadPasswordHash
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var testParams = []PasswordParams{
+	{Alg: PasswordArgon2id, Memory: 1024, Time: 1, Threads: 1},
+	{Alg: PasswordBcrypt, Cost: 4},
+	{Alg: PasswordScrypt, LogN: 4, R: 8, P: 1},
+}
+
+func TestPassword(t *testing.T) {
+	for _, params := range testParams {
+		hash, err := HashPassword("secret", &params)
+		assert.Nil(t, err)
+		t.Log(hash)
+		ok, err := VerifyPassword(hash, "secret")
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		ok, err = VerifyPassword(hash, "Secret")
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		assert.False(t, NeedsRehash(hash, &params))
+		for _, other := range testParams {
+			if other.Alg != params.Alg {
+				assert.True(t, NeedsRehash(hash, &other))
+			}
+		}
+	}
+	_, err := VerifyPassword("$argon2id$v=19$m=1024$abc$def", "secret")
+	assert.Equal(t, ErrBadPasswordHash, err)
+	assert.True(t, NeedsRehash("", &testParams[0]))
+}
+
+func TestLegacyPassword(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	hash := SaltedHash(append([]byte(nil), salt...), "secret")
+	assert.True(t, VerifyLegacyPassword(salt, hash[:], "secret"))
+	assert.False(t, VerifyLegacyPassword(salt, hash[:], "secret!"))
+}
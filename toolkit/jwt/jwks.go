@@ -0,0 +1,147 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+var ErrKeyNotFound = errors.New("jwt: key not found")
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// NewJWK describes a RSA or P-256 public key
+func NewJWK(kid, alg string, pub crypto.PublicKey) (*JWK, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return &JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			N:   encoding.EncodeToString(k.N.Bytes()),
+			E:   encoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, ErrBadKey
+		}
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return &JWK{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			Crv: "P-256",
+			X:   encoding.EncodeToString(x),
+			Y:   encoding.EncodeToString(y),
+		}, nil
+	default:
+		return nil, ErrBadKey
+	}
+}
+
+// PublicKey returns *rsa.PublicKey or *ecdsa.PublicKey
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := encoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := encoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, ErrBadKey
+		}
+		x, err := encoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, ErrBadKey
+	}
+}
+
+func (s *JWKS) Find(kid string) *JWK {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// KeyFunc verifies tokens with the key of the same kid in the set
+func (s *JWKS) KeyFunc(h *Header) (interface{}, error) {
+	k := s.Find(h.Kid)
+	if k == nil {
+		return nil, ErrKeyNotFound
+	}
+	if k.Alg != "" && k.Alg != h.Alg {
+		return nil, ErrBadAlg
+	}
+	return k.PublicKey()
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS1, PKCS8 or SEC1 private key
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: no PEM data found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, ErrBadKey
+	}
+	return signer, nil
+}
@@ -0,0 +1,239 @@
+// Package jwt signs and verifies compact JWS tokens (HS256, RS256 and ES256)
+// and handles JSON Web Key Sets.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	ErrMalformed    = errors.New("jwt: malformed token")
+	ErrBadAlg       = errors.New("jwt: unexpected algorithm")
+	ErrBadKey       = errors.New("jwt: key does not fit algorithm")
+	ErrBadSignature = errors.New("jwt: bad signature")
+	ErrExpired      = errors.New("jwt: token expired")
+	ErrNotValidYet  = errors.New("jwt: token not valid yet")
+
+	encoding = base64.RawURLEncoding
+)
+
+type Header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// KeyFunc returns the verification key for a token, []byte for HS256,
+// *rsa.PublicKey for RS256 and *ecdsa.PublicKey for ES256.
+type KeyFunc func(h *Header) (interface{}, error)
+
+type StandardClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Id        string   `json:"jti,omitempty"`
+}
+
+// Audience is a string or an array of strings in JSON
+type Audience []string
+
+// Valid checks exp and nbf against now
+func (c *StandardClaims) Valid(now time.Time) error {
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return ErrNotValidYet
+	}
+	return nil
+}
+
+func (a Audience) Contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(b, &strs); err != nil {
+		return err
+	}
+	*a = Audience(strs)
+	return nil
+}
+
+// Sign returns a compact JWS of claims, key is []byte for HS256,
+// *rsa.PrivateKey for RS256 and *ecdsa.PrivateKey for ES256.
+func Sign(claims interface{}, alg, kid string, key interface{}) (string, error) {
+	header, err := json.Marshal(&Header{Alg: alg, Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	sig, err := sign([]byte(signingInput), alg, key)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encoding.EncodeToString(sig), nil
+}
+
+// Parse verifies the signature of token and decodes its payload into claims.
+// Time based claims are not checked, see StandardClaims.Valid.
+func Parse(token string, keyFunc KeyFunc, claims interface{}) (*Header, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	hb, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var header Header
+	if err := json.Unmarshal(hb, &header); err != nil {
+		return nil, ErrMalformed
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	key, err := keyFunc(&header)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify([]byte(parts[0]+"."+parts[1]), sig, header.Alg, key); err != nil {
+		return nil, err
+	}
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrMalformed
+	}
+	return &header, nil
+}
+
+// IsJwt tells compact JWS tokens apart from other token formats
+func IsJwt(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func sign(data []byte, alg string, key interface{}) ([]byte, error) {
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return nil, ErrBadKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case RS256:
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrBadKey
+		}
+		hash := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hash[:])
+	case ES256:
+		priv, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, ErrBadKey
+		}
+		hash := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		// r and s are padded to 32 bytes each as per RFC 7518
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	default:
+		return nil, ErrBadAlg
+	}
+}
+
+func verify(data, sig []byte, alg string, key interface{}) error {
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrBadKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrBadSignature
+		}
+		return nil
+	case RS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrBadKey
+		}
+		hash := sha256.Sum256(data)
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return ErrBadSignature
+		}
+		return nil
+	case ES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrBadKey
+		}
+		if len(sig) != 64 {
+			return ErrBadSignature
+		}
+		hash := sha256.Sum256(data)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return ErrBadSignature
+		}
+		return nil
+	default:
+		return ErrBadAlg
+	}
+}
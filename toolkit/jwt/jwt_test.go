@@ -0,0 +1,71 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	StandardClaims
+	Role int `json:"role"`
+}
+
+func TestJwt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	secret := []byte("secret")
+
+	rsaJwk, err := NewJWK("r1", RS256, &rsaKey.PublicKey)
+	assert.Nil(t, err)
+	ecJwk, err := NewJWK("e1", ES256, &ecKey.PublicKey)
+	assert.Nil(t, err)
+	// round trip through JSON like a fetched key set
+	data, _ := json.Marshal(&JWKS{[]*JWK{rsaJwk, ecJwk}})
+	var set JWKS
+	assert.Nil(t, json.Unmarshal(data, &set))
+
+	claims := &testClaims{StandardClaims{
+		Subject:   "123",
+		Audience:  Audience{"app"},
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, 100}
+	for _, c := range []struct {
+		alg, kid string
+		key      interface{}
+		keyFunc  KeyFunc
+	}{
+		{HS256, "", secret, func(h *Header) (interface{}, error) { return secret, nil }},
+		{RS256, "r1", rsaKey, set.KeyFunc},
+		{ES256, "e1", ecKey, set.KeyFunc},
+	} {
+		token, err := Sign(claims, c.alg, c.kid, c.key)
+		assert.Nil(t, err)
+		assert.True(t, IsJwt(token))
+		var parsed testClaims
+		h, err := Parse(token, c.keyFunc, &parsed)
+		assert.Nil(t, err, c.alg)
+		assert.Equal(t, c.alg, h.Alg)
+		assert.Equal(t, *claims, parsed)
+		assert.Nil(t, parsed.Valid(time.Now()))
+		assert.True(t, parsed.Audience.Contains("app"))
+
+		_, err = Parse(token[:len(token)-2]+"xx", c.keyFunc, &parsed)
+		assert.NotNil(t, err)
+	}
+
+	// alg confusion: HS256 token checked against a RSA key
+	token, _ := Sign(claims, HS256, "r1", secret)
+	_, err = Parse(token, set.KeyFunc, &testClaims{})
+	assert.NotNil(t, err)
+
+	claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, ErrExpired, claims.Valid(time.Now()))
+}
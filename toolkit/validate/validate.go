@@ -0,0 +1,370 @@
+// Package validate checks struct fields against rules declared in the
+// "validate" struct tag, e.g.
+//
+//	Mobile   string `validate:"required,mobile"`
+//	Age      int    `validate:"min=18,max=150"`
+//	Kind     string `validate:"enum=a|b|c"`
+//	Code     string `validate:"len=6,regex=^[0-9]+$"`
+//
+// Rules are separated by commas. "regex" must be the last rule since
+// everything after "regex=" is taken as the pattern. Empty values of fields
+// without "required" are not checked against other rules.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const TagName = "validate"
+
+const (
+	RuleRequired = "required"
+	RuleMin      = "min"
+	RuleMax      = "max"
+	RuleLen      = "len"
+	RuleRegex    = "regex"
+	RuleEnum     = "enum"
+	RuleMobile   = "mobile"
+	RuleEmail    = "email"
+)
+
+var (
+	mobileRegexp = regexp.MustCompile(`^1[3-9][0-9]{9}$`)
+	emailRegexp  = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+	cache = make(map[reflect.Type]*Validator)
+	lock  sync.RWMutex
+)
+
+type Rule struct {
+	Name string
+	Arg  string
+}
+
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+}
+
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	strs := make([]string, 0, len(e))
+	for _, fe := range e {
+		strs = append(strs, fe.Field+" ("+fe.Rule+")")
+	}
+	return "Invalid fields: " + strings.Join(strs, ", ")
+}
+
+type Validator struct {
+	fields []*field
+}
+
+type field struct {
+	index  int
+	name   string
+	rules  []*rule
+	nested *Validator
+	elem   bool // nested applies to slice elements
+}
+
+type rule struct {
+	Rule
+	num   float64
+	enum  []string
+	regex *regexp.Regexp
+}
+
+// Compile builds a Validator for struct type t, it returns nil if neither t
+// nor its nested structs declare any rule. Top level fields named in skip
+// are ignored.
+func Compile(t reflect.Type, skip ...string) (*Validator, error) {
+	return compile(t, make(map[reflect.Type]bool), skip)
+}
+
+// Struct validates v, a struct or a pointer to struct, with a cached Validator
+func Struct(v interface{}) error {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	lock.RLock()
+	va, ok := cache[t]
+	lock.RUnlock()
+	if !ok {
+		var err error
+		if va, err = Compile(t); err != nil {
+			return err
+		}
+		lock.Lock()
+		cache[t] = va
+		lock.Unlock()
+	}
+	if errs := va.Validate(v); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ParseTag parses the content of a "validate" tag
+func ParseTag(tag string) ([]Rule, error) {
+	var rules []Rule
+	for tag != "" {
+		part := tag
+		if strings.HasPrefix(tag, RuleRegex+"=") {
+			tag = ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			part, tag = tag[:i], tag[i+1:]
+		} else {
+			tag = ""
+		}
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r := Rule{Name: part}
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			r.Name, r.Arg = part[:i], part[i+1:]
+		}
+		switch r.Name {
+		case RuleRequired, RuleMobile, RuleEmail:
+		case RuleMin, RuleMax, RuleLen, RuleRegex, RuleEnum:
+			if r.Arg == "" {
+				return nil, errors.New("validate: rule " + r.Name + " needs an argument")
+			}
+		default:
+			return nil, errors.New("validate: unknown rule " + r.Name)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Validate returns every field of v that breaks its rules
+func (va *Validator) Validate(v interface{}) Errors {
+	if va == nil {
+		return nil
+	}
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	return va.validate(val, "", nil)
+}
+
+func (va *Validator) validate(val reflect.Value, prefix string, errs Errors) Errors {
+	for _, f := range va.fields {
+		fv := val.Field(f.index)
+		name := prefix + f.name
+		for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if isEmpty(fv) {
+			for _, r := range f.rules {
+				if r.Name == RuleRequired {
+					errs = append(errs, &FieldError{name, r.Name})
+				}
+			}
+			continue
+		}
+		for _, r := range f.rules {
+			if !r.check(fv) {
+				errs = append(errs, &FieldError{name, r.String()})
+			}
+		}
+		if f.nested != nil {
+			if f.elem {
+				for i := 0; i < fv.Len(); i++ {
+					ev := fv.Index(i)
+					for ev.Kind() == reflect.Ptr && !ev.IsNil() {
+						ev = ev.Elem()
+					}
+					if ev.Kind() == reflect.Struct {
+						errs = f.nested.validate(ev, name+"["+strconv.Itoa(i)+"].", errs)
+					}
+				}
+			} else if fv.Kind() == reflect.Struct {
+				errs = f.nested.validate(fv, name+".", errs)
+			}
+		}
+	}
+	return errs
+}
+
+func (r *rule) String() string {
+	if r.Arg == "" {
+		return r.Name
+	}
+	return r.Name + "=" + r.Arg
+}
+
+func (r *rule) check(v reflect.Value) bool {
+	switch r.Name {
+	case RuleRequired:
+		return true
+	case RuleMin:
+		n, ok := measure(v)
+		return ok && n >= r.num
+	case RuleMax:
+		n, ok := measure(v)
+		return ok && n <= r.num
+	case RuleLen:
+		n, ok := length(v)
+		return ok && n == r.num
+	case RuleEnum:
+		s := fmt.Sprint(v.Interface())
+		for _, e := range r.enum {
+			if s == e {
+				return true
+			}
+		}
+		return false
+	case RuleRegex:
+		return v.Kind() == reflect.String && r.regex.MatchString(v.String())
+	case RuleMobile:
+		return v.Kind() == reflect.String && mobileRegexp.MatchString(v.String())
+	case RuleEmail:
+		return v.Kind() == reflect.String && emailRegexp.MatchString(v.String())
+	}
+	return false
+}
+
+func compile(t reflect.Type, visiting map[reflect.Type]bool, skip []string) (*Validator, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New("validate: " + t.String() + " is not a struct")
+	}
+	if visiting[t] {
+		return nil, nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	va := &Validator{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" || contains(skip, sf.Name) {
+			continue
+		}
+		f := &field{index: i, name: fieldName(sf)}
+		rules, err := ParseTag(sf.Tag.Get(TagName))
+		if err != nil {
+			return nil, fmt.Errorf("%v, field %s.%s", err, t.Name(), sf.Name)
+		}
+		for _, r := range rules {
+			cr, err := compileRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("%v, field %s.%s", err, t.Name(), sf.Name)
+			}
+			f.rules = append(f.rules, cr)
+		}
+		ft := sf.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Slice || ft.Kind() == reflect.Array {
+			f.elem = true
+			ft = ft.Elem()
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+		}
+		if ft.Kind() == reflect.Struct {
+			if f.nested, err = compile(ft, visiting, nil); err != nil {
+				return nil, err
+			}
+		}
+		if len(f.rules) > 0 || f.nested != nil {
+			va.fields = append(va.fields, f)
+		}
+	}
+	if len(va.fields) == 0 {
+		return nil, nil
+	}
+	return va, nil
+}
+
+func compileRule(r Rule) (*rule, error) {
+	cr := &rule{Rule: r}
+	var err error
+	switch r.Name {
+	case RuleMin, RuleMax, RuleLen:
+		if cr.num, err = strconv.ParseFloat(r.Arg, 64); err != nil {
+			return nil, errors.New("validate: bad number for " + r.Name)
+		}
+	case RuleEnum:
+		cr.enum = strings.Split(r.Arg, "|")
+	case RuleRegex:
+		if cr.regex, err = regexp.Compile(r.Arg); err != nil {
+			return nil, err
+		}
+	}
+	return cr, nil
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldName(sf reflect.StructField) string {
+	for _, tag := range []string{"json", "schema"} {
+		if name := strings.Split(sf.Tag.Get(tag), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return sf.Name
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+// measure returns numbers as they are, and the length of everything else
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return length(v)
+}
+
+func length(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
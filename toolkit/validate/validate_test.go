@@ -0,0 +1,71 @@
+package validate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+type address struct {
+	City string `json:"city" validate:"required"`
+}
+
+type input struct {
+	Mobile  string     `schema:"mobile" validate:"required,mobile"`
+	Email   string     `json:"email" validate:"email"`
+	Age     int        `validate:"min=18,max=150"`
+	Name    *string    `validate:"required,max=4"`
+	Kind    string     `validate:"enum=a|b"`
+	Code    string     `validate:"len=6,regex=^[0-9]{2,6}$"`
+	Address *address   `json:"address"`
+	Others  []*address `json:"others"`
+}
+
+func TestValidate(t *testing.T) {
+	name := "tom"
+	in := &input{
+		Mobile:  "13800138000",
+		Age:     20,
+		Name:    &name,
+		Code:    "123456",
+		Address: &address{"x"},
+	}
+	assert.Nil(t, Struct(in))
+
+	bad := "too long"
+	in = &input{
+		Mobile: "12345",
+		Email:  "foo",
+		Age:    10,
+		Name:   &bad,
+		Kind:   "c",
+		Code:   "12a456",
+		Others: []*address{{"x"}, {}},
+	}
+	err := Struct(in)
+	assert.Equal(t, Errors{
+		{"mobile", "mobile"},
+		{"email", "email"},
+		{"Age", "min=18"},
+		{"Name", "max=4"},
+		{"Kind", "enum=a|b"},
+		{"Code", "regex=^[0-9]{2,6}$"},
+		{"others[1].city", "required"},
+	}, err)
+	t.Log(err)
+
+	assert.Equal(t, Errors{{"mobile", "required"}, {"Name", "required"}}, Struct(&input{}))
+}
+
+func TestParseTag(t *testing.T) {
+	rules, err := ParseTag("required,min=1,regex=^a,b$")
+	assert.Nil(t, err)
+	assert.Equal(t, []Rule{{"required", ""}, {"min", "1"}, {"regex", "^a,b$"}}, rules)
+
+	_, err = ParseTag("foo")
+	assert.NotNil(t, err)
+	_, err = Compile(reflect.TypeOf(struct {
+		A int `validate:"min=x"`
+	}{}))
+	assert.NotNil(t, err)
+}
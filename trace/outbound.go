@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/parnurzeal/gorequest"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"net/url"
+)
+
+// Do is req.End() traced as a child span of ctx, req needs its method and
+// url set. The span context and request id are propagated with req's
+// headers.
+func Do(ctx context.Context, req *gorequest.SuperAgent) (gorequest.Response, string, []error) {
+	done := outbound(ctx, req)
+	resp, body, errs := req.End()
+	done(resp, errs)
+	return resp, body, errs
+}
+
+// DoBytes is Do for req.EndBytes()
+func DoBytes(ctx context.Context, req *gorequest.SuperAgent) (gorequest.Response, []byte, []error) {
+	done := outbound(ctx, req)
+	resp, body, errs := req.EndBytes()
+	done(resp, errs)
+	return resp, body, errs
+}
+
+func outbound(ctx context.Context, req *gorequest.SuperAgent) func(*http.Response, []error) {
+	host := req.Url
+	if u, err := url.Parse(req.Url); err == nil {
+		host = u.Host
+	}
+	ctx, span := Start(ctx, "HTTP "+req.Method+" "+host, KindClient,
+		attribute.String("http.method", req.Method),
+		attribute.String("server.address", host))
+	header := make(http.Header)
+	Inject(ctx, header)
+	for k := range header {
+		req.Set(k, header.Get(k))
+	}
+	if rid := appgo.RequestIdFromContext(ctx); rid != "" {
+		req.Set(appgo.RequestIdHeaderName, rid)
+	}
+	return func(resp *http.Response, errs []error) {
+		var err error
+		if len(errs) > 0 {
+			err = errs[0]
+		} else if resp != nil {
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			if resp.StatusCode >= http.StatusInternalServerError {
+				err = errors.New(resp.Status)
+			}
+		}
+		End(span, err)
+	}
+}
@@ -0,0 +1,148 @@
+// Package trace exports OpenTelemetry spans of API requests and the redis,
+// database and HTTP calls made while serving them. Spans are dropped
+// unless Conf.Tracing is enabled.
+package trace
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const tracerName = "github.com/oxfeeefeee/appgo"
+
+const (
+	KindServer   = oteltrace.SpanKindServer
+	KindClient   = oteltrace.SpanKindClient
+	KindInternal = oteltrace.SpanKindInternal
+)
+
+type Span = oteltrace.Span
+
+var (
+	// Delegates to the provider set in init once tracing is enabled
+	tracer     = otel.Tracer(tracerName)
+	provider   *sdktrace.TracerProvider
+	propagator = propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{})
+)
+
+func init() {
+	otel.SetTextMapPropagator(propagator)
+	c := &appgo.Conf.Tracing
+	if !c.Enable {
+		return
+	}
+	exporter, err := newExporter()
+	if err != nil {
+		log.WithField("error", err).Errorln("failed to create trace exporter")
+		return
+	}
+	name := c.ServiceName
+	if name == "" {
+		name = filepath.Base(os.Args[0])
+	}
+	ratio := c.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+}
+
+func newExporter() (sdktrace.SpanExporter, error) {
+	c := &appgo.Conf.Tracing
+	if c.Exporter == "file" {
+		path := c.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(appgo.RootDir, path)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(f))
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+// Shutdown exports buffered spans, e.g. in a server shutdown hook
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Start starts a span, it's a child of the span in ctx if there's one
+func Start(ctx context.Context, name string, kind oteltrace.SpanKind,
+	attrs ...attribute.KeyValue) (context.Context, Span) {
+	return tracer.Start(ctx, name, oteltrace.WithSpanKind(kind),
+		oteltrace.WithAttributes(attrs...))
+}
+
+func FromContext(ctx context.Context) Span {
+	return oteltrace.SpanFromContext(ctx)
+}
+
+// End ends span, recording err if it's not nil
+func End(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// RecordApiError adds the errcode of an API error to the span in ctx,
+// server errors also mark the span as failed.
+func RecordApiError(ctx context.Context, err *appgo.ApiError) {
+	span := oteltrace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("appgo.errcode", int(err.Code)))
+	if err.HttpCode() >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, err.Msg)
+	}
+}
+
+// Extract returns ctx with the remote span context carried by header
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the headers carrying the span context of ctx
+func Inject(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// LogFields returns the ids of the span in ctx for correlating logs
+func LogFields(ctx context.Context) log.Fields {
+	sc := oteltrace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return log.Fields{}
+	}
+	return log.Fields{
+		"traceId": sc.TraceID().String(),
+		"spanId":  sc.SpanID().String(),
+	}
+}
@@ -1,8 +1,9 @@
 package userSystem
 
 import (
-	//log "github.com/Sirupsen/logrus"
+	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
 )
 
 func (u *UserSystem) ReadUser(id appgo.Id) (*UserData, error) {
@@ -34,7 +35,29 @@ func (u *UserSystem) UpdateUser(id appgo.Id, user *UserData) (*UserData, error)
 }
 
 func (u *UserSystem) DeleteUser(id appgo.Id) error {
-	return U.db.Delete(&UserModel{Id: id}).Error
+	if err := U.db.Delete(&UserModel{Id: id}).Error; err != nil {
+		return err
+	}
+	return u.LogoutAll(id)
+}
+
+// ForceLogout revokes all sessions of user id, e.g. when the account is compromised
+func (u *UserSystem) ForceLogout(id appgo.Id) error {
+	log.WithField("id", id).Infoln("force logout")
+	return u.LogoutAll(id)
+}
+
+// UnlockLogin lifts the password login lockout of user id
+func (u *UserSystem) UnlockLogin(id appgo.Id) error {
+	m := &UserModel{Id: id}
+	if err := U.db.First(m).Error; err != nil {
+		return err
+	}
+	if !m.Mobile.Valid {
+		return nil
+	}
+	log.WithField("id", id).Infoln("unlock login")
+	return auth.UnlockLogin(m.Mobile.String)
 }
 
 func (u *UserSystem) UserCount() (int, error) {
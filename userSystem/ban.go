@@ -0,0 +1,296 @@
+package userSystem
+
+import (
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/database"
+	"github.com/oxfeeefeee/appgo/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BanScopeAll bans logins and all authenticated requests, other scopes
+// are up to apps, see ActiveBan
+const BanScopeAll = "all"
+
+const (
+	banNamespace = "ban"
+	// Bans are published for other instances to drop their caches
+	banChannel = "ban:marked"
+)
+
+// BannedUntil of permanent bans
+var banForever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// BanModel is the history of bans, lifted and expired ones are kept
+type BanModel struct {
+	Id     appgo.Id
+	UserId appgo.Id `gorm:"index"`
+	Scope  string   `gorm:"size:31"`
+	Reason string   `gorm:"size:255"`
+	// nil for permanent bans
+	ExpiresAt *time.Time
+	AdminId   appgo.Id
+	CreatedAt time.Time
+	// Set if unbanned before ExpiresAt
+	LiftedAt *time.Time
+	LiftedBy appgo.Id
+}
+
+// BanInfo is returned by CheckIn for banned users, for clients to display
+type BanInfo struct {
+	Scope  string
+	Reason string
+	// nil for permanent bans
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
+
+// banStore marks users banned with BanScopeAll in redis, so every request
+// can be checked, and caches who isn't banned for Conf.Session.CacheSeconds.
+// Bans are published so all instances drop the user from the cache.
+type banStore struct {
+	users *redis.Strings
+	clean map[appgo.Id]time.Time
+	ttl   time.Duration
+	lock  sync.Mutex
+	// Subscribes on first use, redis may not be set up in Init yet
+	subscribe sync.Once
+}
+
+func (_ *BanModel) TableName() string {
+	return "user_bans"
+}
+
+func newBanStore() *banStore {
+	ttl := appgo.Conf.Session.CacheSeconds
+	if ttl <= 0 {
+		ttl = defaultSessionCacheSeconds
+	}
+	return &banStore{
+		users: redis.NewStrings(banNamespace, 0),
+		clean: make(map[appgo.Id]time.Time),
+		ttl:   time.Duration(ttl) * time.Second,
+	}
+}
+
+// Ban replaces the active ban of scope of user id, duration 0 bans
+// forever. Users banned with BanScopeAll are logged out everywhere, other
+// instances learn about the ban from redis pub/sub; if they miss it while
+// reconnecting, they let the user's requests in for up to
+// Conf.Session.CacheSeconds (unless sessions are enabled, which are
+// revoked right away).
+func (u *UserSystem) Ban(id, adminId appgo.Id, scope, reason string,
+	duration time.Duration) (*BanInfo, error) {
+	if scope == "" {
+		return nil, errors.New("empty ban scope")
+	}
+	if duration < 0 {
+		return nil, errors.New("negative ban duration")
+	}
+	m := &BanModel{UserId: id, Scope: scope, Reason: reason, AdminId: adminId}
+	if duration > 0 {
+		until := time.Now().Add(duration)
+		m.ExpiresAt = &until
+	}
+	err := database.WithTx(context.Background(), u.db, func(tx *gorm.DB) error {
+		if err := liftBans(tx, id, adminId, scope); err != nil {
+			return err
+		}
+		if err := tx.Create(m).Error; err != nil {
+			return err
+		}
+		if scope != BanScopeAll {
+			return nil
+		}
+		until := banForever
+		if m.ExpiresAt != nil {
+			until = *m.ExpiresAt
+		}
+		return tx.Model(&UserModel{Id: id}).
+			Updates(&UserModel{BannedUntil: &until}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"id":      id,
+		"admin":   adminId,
+		"scope":   scope,
+		"reason":  reason,
+		"expires": m.ExpiresAt,
+	}).Infoln("ban user")
+	info := banModelToInfo(m)
+	if scope == BanScopeAll {
+		if err := u.bans.mark(id, info); err != nil {
+			return nil, err
+		}
+		if err := u.LogoutAll(id); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// Unban lifts the active ban of scope of user id
+func (u *UserSystem) Unban(id, adminId appgo.Id, scope string) error {
+	err := database.WithTx(context.Background(), u.db, func(tx *gorm.DB) error {
+		if err := liftBans(tx, id, adminId, scope); err != nil {
+			return err
+		}
+		if scope != BanScopeAll {
+			return nil
+		}
+		return tx.Model(&UserModel{Id: id}).
+			Updates(map[string]interface{}{"banned_until": nil}).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":    id,
+		"admin": adminId,
+		"scope": scope,
+	}).Infoln("unban user")
+	if scope == BanScopeAll {
+		return u.bans.unmark(id)
+	}
+	return nil
+}
+
+// ActiveBan returns the ban of scope of user id, nil if not banned
+func (u *UserSystem) ActiveBan(id appgo.Id, scope string) (*BanInfo, error) {
+	var m BanModel
+	db := activeBans(u.db, id, scope).Order("id desc").First(&m)
+	if db.RecordNotFound() {
+		return nil, nil
+	} else if db.Error != nil {
+		return nil, db.Error
+	}
+	return banModelToInfo(&m), nil
+}
+
+// BanHistory returns all bans of user id, latest first
+func (u *UserSystem) BanHistory(id appgo.Id) ([]*BanModel, error) {
+	var bans []*BanModel
+	if err := u.db.Where("user_id = ?", id).
+		Order("id desc").Find(&bans).Error; err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// checkBan is CheckIn's part, the ban table is only read if BannedUntil
+// of user says so
+func (u *UserSystem) checkBan(user *UserModel) (*BanInfo, error) {
+	if user.BannedUntil == nil || !user.BannedUntil.After(time.Now()) {
+		return nil, nil
+	}
+	info, err := u.ActiveBan(user.Id, BanScopeAll)
+	if err != nil || info == nil {
+		return nil, err
+	}
+	// Restores the mark if redis lost it
+	if err := u.bans.mark(user.Id, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func activeBans(db *gorm.DB, id appgo.Id, scope string) *gorm.DB {
+	return db.Model(&BanModel{}).
+		Where("user_id = ? AND scope = ? AND lifted_at IS NULL", id, scope).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now())
+}
+
+func liftBans(db *gorm.DB, id, adminId appgo.Id, scope string) error {
+	now := time.Now()
+	return activeBans(db, id, scope).Updates(map[string]interface{}{
+		"lifted_at": &now,
+		"lifted_by": adminId,
+	}).Error
+}
+
+func banModelToInfo(m *BanModel) *BanInfo {
+	return &BanInfo{
+		Scope:     m.Scope,
+		Reason:    m.Reason,
+		ExpiresAt: m.ExpiresAt,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+// banned fails open on redis errors, tokens of banned users are revoked
+// anyway if sessions are enabled
+func (s *banStore) banned(id appgo.Id) bool {
+	s.subscribe.Do(func() {
+		sub := redis.NewSubscriber(s.onBan)
+		if err := sub.Subscribe(banChannel); err != nil {
+			log.WithField("error", err).Errorln("failed to subscribe to bans")
+		}
+	})
+	s.lock.Lock()
+	until, ok := s.clean[id]
+	s.lock.Unlock()
+	if ok && until.After(time.Now()) {
+		return false
+	}
+	has, err := s.users.Has(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Errorln("failed to check ban")
+		return false
+	}
+	if !has {
+		s.lock.Lock()
+		// Dropping everything is cheap and keeps memory bounded
+		if len(s.clean) >= sessionCacheSize {
+			s.clean = make(map[appgo.Id]time.Time)
+		}
+		s.clean[id] = time.Now().Add(s.ttl)
+		s.lock.Unlock()
+	}
+	return has
+}
+
+func (s *banStore) mark(id appgo.Id, info *BanInfo) error {
+	s.forget(id)
+	var err error
+	if info.ExpiresAt == nil {
+		err = s.users.Set(id, "0")
+	} else {
+		err = s.users.SetEx(id, ttlUntil(*info.ExpiresAt),
+			strconv.FormatInt(info.ExpiresAt.Unix(), 10))
+	}
+	if err != nil {
+		return err
+	}
+	return redis.Publish(banChannel, []byte(id.String()))
+}
+
+func (s *banStore) onBan(channel string, data []byte) {
+	s.forget(appgo.IdFromStr(string(data)))
+}
+
+func (s *banStore) forget(id appgo.Id) {
+	s.lock.Lock()
+	delete(s.clean, id)
+	s.lock.Unlock()
+}
+
+func (s *banStore) unmark(id appgo.Id) error {
+	return s.users.Del(id)
+}
+
+// validateBan is Validate's part
+func (u *UserSystem) validateBan(token auth.Token) bool {
+	c := token.Claims()
+	return c != nil && !u.bans.banned(c.UserId)
+}
@@ -0,0 +1,138 @@
+package userSystem
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/database"
+	"github.com/oxfeeefeee/appgo/services/oidc"
+	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+	"time"
+)
+
+// IdentityModel links users to accounts of oidc providers and of the
+// OAuths of UserSystemSettings ("oauth0", "oauth1", ...)
+type IdentityModel struct {
+	Id       appgo.Id
+	UserId   appgo.Id `gorm:"index"`
+	Provider string   `gorm:"size:31;unique_index:idx_provider_subject"`
+	Subject  string   `gorm:"size:127;unique_index:idx_provider_subject"`
+	// Email the provider reported, informational
+	Email     sql.NullString `gorm:"size:63"`
+	CreatedAt time.Time
+}
+
+func (_ *IdentityModel) TableName() string {
+	return "user_identities"
+}
+
+func (u *UserSystem) GetIdentityUser(provider, subject string) (appgo.Id, error) {
+	var m IdentityModel
+	db := u.db.Where(&IdentityModel{Provider: provider, Subject: subject}).First(&m)
+	if db.RecordNotFound() {
+		return 0, nil
+	} else if db.Error != nil {
+		return 0, db.Error
+	}
+	return m.UserId, nil
+}
+
+func (u *UserSystem) AddIdentityUser(info *oidc.UserInfo) (appgo.Id, error) {
+	user := &UserModel{
+		Role:     appgo.RoleAppUser,
+		Nickname: database.SqlStr(info.Nickname),
+	}
+	if info.Portrait != "" {
+		name := info.Provider + "_user_" + hex.EncodeToString(crypto.Md5([]byte(info.Subject)))
+		name, _ = copyImage(info.Portrait, name)
+		user.Portrait = database.SqlStr(name)
+	}
+	// Emails are unique, users who signed up otherwise keep theirs
+	if info.Email != "" && info.EmailVerified {
+		if uid, err := getUser(u.db, &UserModel{
+			Email: database.SqlStr(info.Email)}); err != nil {
+			return 0, err
+		} else if uid == 0 {
+			user.Email = database.SqlStr(info.Email)
+		}
+	}
+	identity := &IdentityModel{
+		Provider: info.Provider,
+		Subject:  info.Subject,
+	}
+	if info.Email != "" {
+		identity.Email = database.SqlStr(info.Email)
+	}
+	return u.saveIdentityUser(user, identity)
+}
+
+// saveIdentityUser creates user along with its identity
+func (u *UserSystem) saveIdentityUser(user *UserModel, identity *IdentityModel) (appgo.Id, error) {
+	err := database.WithTx(context.Background(), u.db, func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		identity.UserId = user.Id
+		return tx.Create(identity).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	if u.OnCreated != nil {
+		return user.Id, u.OnCreated(user.Id)
+	}
+	return user.Id, nil
+}
+
+// migrateOAuthIds moves the deprecated OAuth0Id and OAuth1Id columns to
+// user_identities, migrated columns are cleared so it's cheap to rerun
+func migrateOAuthIds(db *gorm.DB) {
+	scope := db.NewScope(&UserModel{})
+	for index, name := range []string{"OAuth0Id", "OAuth1Id"} {
+		field, ok := scope.FieldByName(name)
+		if !ok {
+			continue
+		}
+		var users []*UserModel
+		if err := db.Where(field.DBName + " IS NOT NULL").Find(&users).Error; err != nil {
+			log.WithFields(log.Fields{
+				"gormError": err,
+			}).Errorln("failed to read oauth ids")
+			continue
+		}
+		for _, user := range users {
+			subject := user.OAuth0Id.String
+			if index == 1 {
+				subject = user.OAuth1Id.String
+			}
+			err := database.WithTx(context.Background(), db, func(tx *gorm.DB) error {
+				identity := &IdentityModel{
+					UserId:   user.Id,
+					Provider: auth.OAuthProvider(index),
+					Subject:  subject,
+				}
+				if err := tx.Where(&IdentityModel{
+					Provider: identity.Provider,
+					Subject:  subject,
+				}).FirstOrCreate(identity).Error; err != nil {
+					return err
+				}
+				return tx.Model(&UserModel{Id: user.Id}).
+					Updates(map[string]interface{}{field.DBName: nil}).Error
+			})
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":        user.Id,
+					"gormError": err,
+				}).Errorln("failed to migrate oauth id")
+			}
+		}
+		if len(users) > 0 {
+			log.WithField("count", len(users)).Infoln("migrated " + name)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package userSystem
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/database"
+	"time"
+)
+
+// Identities kept in columns of UserModel, others are in user_identities
+var columnProviders = []struct {
+	provider string
+	field    string
+}{
+	{auth.ProviderMobile, "Mobile"},
+	{auth.ProviderWeixin, "WeixinUnionId"},
+	{auth.ProviderWeibo, "WeiboId"},
+	{auth.ProviderQq, "QqOpenId"},
+	{auth.ProviderApple, "AppleId"},
+}
+
+// Password fields go along with Mobile
+var passwordFields = []string{"Password", "PasswordSalt", "PasswordHash"}
+
+// LinkIdentity implements auth.LinkSupport, linking an identity twice is
+// fine. Mobiles are linked by auth.MobileVerifySet.
+func (u *UserSystem) LinkIdentity(uid appgo.Id, provider, subject string) error {
+	if provider == auth.ProviderMobile {
+		return errors.New("mobiles need to be verified")
+	}
+	if subject == "" {
+		return errors.New("empty identity subject")
+	}
+	linked := false
+	err := database.WithTx(context.Background(), u.db, func(tx *gorm.DB) error {
+		// Concurrent links of the same provider wait for each other
+		user, err := lockUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		owner, err := u.identityOwner(tx, provider, subject)
+		if err != nil {
+			return err
+		} else if owner == uid {
+			return nil
+		} else if owner != 0 {
+			return appgo.IdentityTakenErr
+		}
+		methods, err := u.loginMethods(tx, user)
+		if err != nil {
+			return err
+		}
+		if hasProvider(methods, provider) {
+			return appgo.ProviderLinkedErr
+		}
+		linked = true
+		if field := providerField(provider); field != "" {
+			return tx.Model(&UserModel{Id: uid}).Updates(map[string]interface{}{
+				u.column(field): subject,
+			}).Error
+		}
+		return tx.Create(&IdentityModel{
+			UserId:   uid,
+			Provider: provider,
+			Subject:  subject,
+		}).Error
+	})
+	if err != nil || !linked {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":       uid,
+		"provider": provider,
+	}).Infoln("link identity")
+	return nil
+}
+
+// UnlinkIdentity implements auth.LinkSupport, unlinking the mobile clears
+// the password too
+func (u *UserSystem) UnlinkIdentity(uid appgo.Id, provider string) error {
+	err := database.WithTx(context.Background(), u.db, func(tx *gorm.DB) error {
+		// Concurrent unlinks can't remove the last two login methods
+		user, err := lockUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		methods, err := u.loginMethods(tx, user)
+		if err != nil {
+			return err
+		}
+		if !hasProvider(methods, provider) {
+			return appgo.NotFoundErr
+		}
+		if len(methods) <= 1 {
+			return appgo.LastLoginMethodErr
+		}
+		if field := providerField(provider); field != "" {
+			updates := map[string]interface{}{u.column(field): nil}
+			if provider == auth.ProviderMobile {
+				for _, f := range passwordFields {
+					updates[u.column(f)] = nil
+				}
+			}
+			return tx.Model(&UserModel{Id: uid}).Updates(updates).Error
+		}
+		return tx.Where("user_id = ? AND provider = ?", uid, provider).
+			Delete(&IdentityModel{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":       uid,
+		"provider": provider,
+	}).Infoln("unlink identity")
+	return nil
+}
+
+// LoginMethods returns the providers user id can log in with
+func (u *UserSystem) LoginMethods(id appgo.Id) ([]string, error) {
+	user, err := u.GetUserModel(id)
+	if err != nil {
+		return nil, err
+	}
+	return u.loginMethods(u.db, user)
+}
+
+func (u *UserSystem) loginMethods(db *gorm.DB, user *UserModel) ([]string, error) {
+	var ret []string
+	scope := db.NewScope(user)
+	for _, cp := range columnProviders {
+		if f, ok := scope.FieldByName(cp.field); ok && f.Field.Interface().(sql.NullString).Valid {
+			ret = append(ret, cp.provider)
+		}
+	}
+	var identities []*IdentityModel
+	if err := db.Where("user_id = ?", user.Id).Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range identities {
+		ret = append(ret, m.Provider)
+	}
+	return ret, nil
+}
+
+// MergeUsers folds user from into user into, e.g. duplicates made before
+// identities could be linked. Identities, roles and bans of from are
+// moved, so are its unique and profile fields into lacks, then from is
+// deleted and OnMerged is called. It fails with IdentityTakenErr if both
+// users have different identities of a provider.
+func (u *UserSystem) MergeUsers(from, into, adminId appgo.Id) error {
+	if from == into {
+		return errors.New("can't merge a user into itself")
+	}
+	banned := false
+	err := database.WithTx(context.Background(), u.db, func(tx *gorm.DB) error {
+		// Locked in id order, so concurrent merges can't deadlock
+		first, second := from, into
+		if first > second {
+			first, second = second, first
+		}
+		users := make(map[appgo.Id]*UserModel)
+		for _, id := range []appgo.Id{first, second} {
+			user, err := lockUser(tx, id)
+			if err != nil {
+				return err
+			}
+			users[id] = user
+		}
+		fromUser, intoUser := users[from], users[into]
+		if err := mergeColumns(tx, fromUser, intoUser); err != nil {
+			return err
+		}
+		if err := mergeIdentities(tx, from, into); err != nil {
+			return err
+		}
+		var roles []*UserRoleModel
+		if err := tx.Where("user_id = ?", from).Find(&roles).Error; err != nil {
+			return err
+		}
+		for _, r := range roles {
+			if err := tx.Where(&UserRoleModel{UserId: into, RoleId: r.RoleId}).
+				FirstOrCreate(&UserRoleModel{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", from).Delete(&UserRoleModel{}).Error; err != nil {
+			return err
+		}
+		var err error
+		if banned, err = mergeBans(tx, fromUser, intoUser); err != nil {
+			return err
+		}
+		return tx.Delete(&UserModel{Id: from}).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"from":  from,
+		"into":  into,
+		"admin": adminId,
+	}).Infoln("merge users")
+	u.permissions.remove(into)
+	if err := u.LogoutAll(from); err != nil {
+		return err
+	}
+	if banned {
+		info, err := u.ActiveBan(into, BanScopeAll)
+		if err != nil {
+			return err
+		}
+		if info != nil {
+			if err := u.bans.mark(into, info); err != nil {
+				return err
+			}
+			if err := u.LogoutAll(into); err != nil {
+				return err
+			}
+		}
+	}
+	if u.OnMerged != nil {
+		return u.OnMerged(from, into)
+	}
+	return nil
+}
+
+// mergeBans moves the bans of from, so merging doesn't lift them, into is
+// banned until the later BannedUntil of both. It returns true if into is
+// banned by from's ban.
+func mergeBans(tx *gorm.DB, from, into *UserModel) (bool, error) {
+	if err := tx.Model(&BanModel{}).Where("user_id = ?", from.Id).
+		Updates(map[string]interface{}{"user_id": into.Id}).Error; err != nil {
+		return false, err
+	}
+	until := from.BannedUntil
+	if until == nil || !until.After(time.Now()) ||
+		(into.BannedUntil != nil && !until.After(*into.BannedUntil)) {
+		return false, nil
+	}
+	return true, tx.Model(&UserModel{Id: into.Id}).
+		Updates(&UserModel{BannedUntil: until}).Error
+}
+
+// mergeColumns clears the unique fields of from, so they can be moved and
+// aren't kept by the soft deleted row
+func mergeColumns(tx *gorm.DB, from, into *UserModel) error {
+	fromScope, intoScope := tx.NewScope(from), tx.NewScope(into)
+	value := func(s *gorm.Scope, name string) sql.NullString {
+		f, _ := s.FieldByName(name)
+		return f.Field.Interface().(sql.NullString)
+	}
+	clear := make(map[string]interface{})
+	set := make(map[string]interface{})
+	move := func(name string) {
+		f, _ := fromScope.FieldByName(name)
+		clear[f.DBName] = nil
+		if v := value(fromScope, name); v.Valid && !value(intoScope, name).Valid {
+			set[f.DBName] = v
+		}
+	}
+	for _, cp := range columnProviders {
+		fv, iv := value(fromScope, cp.field), value(intoScope, cp.field)
+		if fv.Valid && iv.Valid && fv.String != iv.String {
+			return appgo.IdentityTakenErr.WithData(map[string]string{"provider": cp.provider})
+		}
+		move(cp.field)
+	}
+	for _, name := range []string{"Username", "Email"} {
+		move(name)
+	}
+	if from.Mobile.Valid && !into.Mobile.Valid {
+		for _, name := range passwordFields {
+			f, _ := fromScope.FieldByName(name)
+			set[f.DBName] = f.Field.Interface()
+		}
+	}
+	for _, name := range []string{"Nickname", "Portrait"} {
+		if v := value(fromScope, name); v.Valid && value(intoScope, name).String == "" {
+			f, _ := intoScope.FieldByName(name)
+			set[f.DBName] = v
+		}
+	}
+	if err := tx.Model(&UserModel{Id: from.Id}).Updates(clear).Error; err != nil {
+		return err
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return tx.Model(&UserModel{Id: into.Id}).Updates(set).Error
+}
+
+func mergeIdentities(tx *gorm.DB, from, into appgo.Id) error {
+	var fromIds, intoIds []*IdentityModel
+	if err := tx.Where("user_id = ?", from).Find(&fromIds).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", into).Find(&intoIds).Error; err != nil {
+		return err
+	}
+	for _, f := range fromIds {
+		for _, i := range intoIds {
+			if f.Provider == i.Provider && f.Subject != i.Subject {
+				return appgo.IdentityTakenErr.WithData(map[string]string{"provider": f.Provider})
+			}
+		}
+	}
+	return tx.Model(&IdentityModel{}).Where("user_id = ?", from).
+		Updates(map[string]interface{}{"user_id": into}).Error
+}
+
+// identityOwner returns the user provider's subject is linked to
+func (u *UserSystem) identityOwner(db *gorm.DB, provider, subject string) (appgo.Id, error) {
+	field := providerField(provider)
+	if field == "" {
+		var m IdentityModel
+		if q := db.Where(&IdentityModel{Provider: provider, Subject: subject}).
+			First(&m); q.Error != nil {
+			if q.RecordNotFound() {
+				return 0, nil
+			}
+			return 0, q.Error
+		}
+		return m.UserId, nil
+	}
+	var user UserModel
+	if q := db.Where(u.column(field)+" = ?", subject).First(&user); q.Error != nil {
+		if q.RecordNotFound() {
+			return 0, nil
+		}
+		return 0, q.Error
+	}
+	return user.Id, nil
+}
+
+// lockUser reads user id for the rest of transaction tx, changes of its
+// identities are serialized this way
+func lockUser(tx *gorm.DB, id appgo.Id) (*UserModel, error) {
+	user := &UserModel{Id: id}
+	if db := tx.Set("gorm:query_option", "FOR UPDATE").First(user); db.Error != nil {
+		if db.RecordNotFound() {
+			return nil, appgo.NotFoundErr
+		}
+		return nil, db.Error
+	}
+	return user, nil
+}
+
+func (u *UserSystem) column(field string) string {
+	f, _ := u.db.NewScope(&UserModel{}).FieldByName(field)
+	return f.DBName
+}
+
+func providerField(provider string) string {
+	for _, cp := range columnProviders {
+		if cp.provider == provider {
+			return cp.field
+		}
+	}
+	return ""
+}
+
+func hasProvider(providers []string, provider string) bool {
+	for _, p := range providers {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
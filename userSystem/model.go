@@ -7,17 +7,22 @@ import (
 )
 
 type UserModel struct {
-	Id            appgo.Id
-	Username      sql.NullString `gorm:"size:63;unique_index"`
-	Email         sql.NullString `gorm:"size:63;unique_index"`
-	Mobile        sql.NullString `gorm:"size:15;unique_index"`
+	Id       appgo.Id
+	Username sql.NullString `gorm:"size:63;unique_index"`
+	Email    sql.NullString `gorm:"size:63;unique_index"`
+	Mobile   sql.NullString `gorm:"size:15;unique_index"`
+	// Encoded by crypto.HashPassword
+	Password sql.NullString `gorm:"size:255"`
+	// Legacy crypto.SaltedHash, cleared once Password is set
 	PasswordSalt  []byte         `gorm:"size:64"`
 	PasswordHash  []byte         `gorm:"size:64"`
 	WeiboId       sql.NullString `gorm:"size:63;unique_index"`
 	WeixinUnionId sql.NullString `gorm:"size:63;unique_index"`
 	QqOpenId      sql.NullString `gorm:"size:63;unique_index"`
-	OAuth0Id      sql.NullString `gorm:"size:63;unique_index"`
-	OAuth1Id      sql.NullString `gorm:"size:63;unique_index"`
+	AppleId       sql.NullString `gorm:"size:63;unique_index"`
+	// Deprecated, moved to user_identities by Init
+	OAuth0Id sql.NullString `gorm:"size:63;unique_index"`
+	OAuth1Id sql.NullString `gorm:"size:63;unique_index"`
 	// Only store appToken because webTokens are short lived
 	AppToken     sql.NullString `gorm:"size:127"`
 	Role         appgo.Role
@@ -0,0 +1,79 @@
+package userSystem
+
+import (
+	"database/sql"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+)
+
+// passwordParams applies Conf.Password over crypto.DefaultPasswordParams
+func passwordParams() *crypto.PasswordParams {
+	c := appgo.Conf.Password
+	p := crypto.DefaultPasswordParams
+	if c.Alg != "" {
+		p.Alg = c.Alg
+	}
+	if c.Argon2Memory > 0 {
+		p.Memory = uint32(c.Argon2Memory)
+	}
+	if c.Argon2Time > 0 {
+		p.Time = uint32(c.Argon2Time)
+	}
+	if c.Argon2Threads > 0 {
+		p.Threads = uint8(c.Argon2Threads)
+	}
+	if c.BcryptCost > 0 {
+		p.Cost = c.BcryptCost
+	}
+	if c.ScryptLogN > 0 {
+		p.LogN = uint8(c.ScryptLogN)
+	}
+	return &p
+}
+
+func hashPassword(password string) (sql.NullString, error) {
+	hash, err := crypto.HashPassword(password, passwordParams())
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{hash, true}, nil
+}
+
+// checkPassword verifies password against either hash of user, and
+// replaces legacy or outdated hashes once it's verified
+func (u *UserSystem) checkPassword(user *UserModel, password string) (bool, error) {
+	if user.Password.Valid {
+		ok, err := crypto.VerifyPassword(user.Password.String, password)
+		if err != nil || !ok {
+			return false, err
+		}
+		if crypto.NeedsRehash(user.Password.String, passwordParams()) {
+			u.rehashPassword(user, password)
+		}
+		return true, nil
+	}
+	if !crypto.VerifyLegacyPassword(user.PasswordSalt, user.PasswordHash, password) {
+		return false, nil
+	}
+	u.rehashPassword(user, password)
+	return true, nil
+}
+
+// rehashPassword only logs errors, the login goes on with the old hash
+func (u *UserSystem) rehashPassword(user *UserModel, password string) {
+	hash, err := hashPassword(password)
+	if err == nil {
+		err = u.db.Model(&UserModel{Id: user.Id}).Updates(map[string]interface{}{
+			"password":      hash,
+			"password_salt": nil,
+			"password_hash": nil,
+		}).Error
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    user.Id,
+			"error": err,
+		}).Errorln("failed to rehash password")
+	}
+}
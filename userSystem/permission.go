@@ -0,0 +1,289 @@
+package userSystem
+
+import (
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PermissionAll grants every permission, "user.*" grants all permissions
+// starting with "user."
+const PermissionAll = "*"
+
+const (
+	permissionSeparator = ","
+	permissionCacheSize = 100000
+)
+
+type RoleModel struct {
+	Id   appgo.Id
+	Name string `gorm:"size:63;unique_index"`
+	// Comma separated
+	Permissions string `gorm:"size:2047"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type UserRoleModel struct {
+	Id        appgo.Id
+	UserId    appgo.Id `gorm:"unique_index:idx_user_role"`
+	RoleId    appgo.Id `gorm:"unique_index:idx_user_role;index"`
+	CreatedAt time.Time
+}
+
+type RoleData struct {
+	Id          appgo.Id
+	Name        string
+	Permissions []string
+}
+
+// permissionCache keeps the permissions of users for Conf.Session.CacheSeconds,
+// changes made on other instances show up once entries expire
+type permissionCache struct {
+	m    map[appgo.Id]*cachedPermissions
+	ttl  time.Duration
+	lock sync.Mutex
+}
+
+type cachedPermissions struct {
+	perms []string
+	until time.Time
+}
+
+func newPermissionCache() *permissionCache {
+	ttl := appgo.Conf.Session.CacheSeconds
+	if ttl <= 0 {
+		ttl = defaultSessionCacheSeconds
+	}
+	return &permissionCache{
+		m:   make(map[appgo.Id]*cachedPermissions),
+		ttl: time.Duration(ttl) * time.Second,
+	}
+}
+
+func (_ *RoleModel) TableName() string {
+	return "roles"
+}
+
+func (_ *UserRoleModel) TableName() string {
+	return "user_roles"
+}
+
+func (u *UserSystem) CreateRole(name string, permissions []string) (*RoleData, error) {
+	if name == "" {
+		return nil, errors.New("empty role name")
+	}
+	perms, err := joinPermissions(permissions)
+	if err != nil {
+		return nil, err
+	}
+	m := &RoleModel{Name: name, Permissions: perms}
+	if err := u.db.Create(m).Error; err != nil {
+		return nil, err
+	}
+	return roleModelToData(m), nil
+}
+
+func (u *UserSystem) UpdateRole(name string, permissions []string) error {
+	perms, err := joinPermissions(permissions)
+	if err != nil {
+		return err
+	}
+	m, err := u.getRoleModel(name)
+	if err != nil {
+		return err
+	}
+	if err := u.db.Model(m).Update("permissions", perms).Error; err != nil {
+		return err
+	}
+	u.permissions.clear()
+	return nil
+}
+
+// DeleteRole deletes the role and takes it from all users
+func (u *UserSystem) DeleteRole(name string) error {
+	m, err := u.getRoleModel(name)
+	if err != nil {
+		return err
+	}
+	if err := u.db.Where("role_id = ?", m.Id).Delete(&UserRoleModel{}).Error; err != nil {
+		return err
+	}
+	if err := u.db.Delete(m).Error; err != nil {
+		return err
+	}
+	u.permissions.clear()
+	return nil
+}
+
+func (u *UserSystem) Roles() ([]*RoleData, error) {
+	var roles []*RoleModel
+	if err := u.db.Order("id").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	ret := make([]*RoleData, 0, len(roles))
+	for _, m := range roles {
+		ret = append(ret, roleModelToData(m))
+	}
+	return ret, nil
+}
+
+func (u *UserSystem) AssignRole(id appgo.Id, name string) error {
+	m, err := u.getRoleModel(name)
+	if err != nil {
+		return err
+	}
+	ur := &UserRoleModel{}
+	if err := u.db.Where(&UserRoleModel{UserId: id, RoleId: m.Id}).
+		FirstOrCreate(ur).Error; err != nil {
+		return err
+	}
+	u.permissions.remove(id)
+	return nil
+}
+
+func (u *UserSystem) RevokeRole(id appgo.Id, name string) error {
+	m, err := u.getRoleModel(name)
+	if err != nil {
+		return err
+	}
+	if err := u.db.Where("user_id = ? AND role_id = ?", id, m.Id).
+		Delete(&UserRoleModel{}).Error; err != nil {
+		return err
+	}
+	u.permissions.remove(id)
+	return nil
+}
+
+func (u *UserSystem) UserRoles(id appgo.Id) ([]*RoleData, error) {
+	var roles []*RoleModel
+	err := u.db.Table((&RoleModel{}).TableName()+" r").
+		Select("r.*").
+		Joins("JOIN "+(&UserRoleModel{}).TableName()+" ur ON ur.role_id = r.id").
+		Where("ur.user_id = ?", id).
+		Order("r.id").
+		Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*RoleData, 0, len(roles))
+	for _, m := range roles {
+		ret = append(ret, roleModelToData(m))
+	}
+	return ret, nil
+}
+
+// UserPermissions returns all permissions granted by the roles of id
+func (u *UserSystem) UserPermissions(id appgo.Id) ([]string, error) {
+	roles, err := u.UserRoles(id)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var perms []string
+	for _, r := range roles {
+		for _, p := range r.Permissions {
+			if !seen[p] {
+				seen[p] = true
+				perms = append(perms, p)
+			}
+		}
+	}
+	return perms, nil
+}
+
+// HasPermissions implements server.PermissionChecker, permissions are
+// cached like sessions
+func (u *UserSystem) HasPermissions(id appgo.Id, perms []string) (bool, error) {
+	granted, ok := u.permissions.get(id)
+	if !ok {
+		var err error
+		if granted, err = u.UserPermissions(id); err != nil {
+			return false, err
+		}
+		u.permissions.add(id, granted)
+	}
+	for _, p := range perms {
+		if !permissionGranted(granted, p) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (u *UserSystem) getRoleModel(name string) (*RoleModel, error) {
+	m := &RoleModel{}
+	if db := u.db.Where("name = ?", name).First(m); db.Error != nil {
+		if db.RecordNotFound() {
+			return nil, appgo.NotFoundErr
+		}
+		return nil, db.Error
+	}
+	return m, nil
+}
+
+func permissionGranted(granted []string, perm string) bool {
+	for _, g := range granted {
+		if g == perm || g == PermissionAll {
+			return true
+		}
+		if strings.HasSuffix(g, ".*") && strings.HasPrefix(perm, g[:len(g)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPermissions(perms []string) (string, error) {
+	for _, p := range perms {
+		if p == "" || strings.Contains(p, permissionSeparator) {
+			return "", errors.New("bad permission name: " + p)
+		}
+	}
+	return strings.Join(perms, permissionSeparator), nil
+}
+
+func roleModelToData(m *RoleModel) *RoleData {
+	var perms []string
+	if m.Permissions != "" {
+		perms = strings.Split(m.Permissions, permissionSeparator)
+	}
+	return &RoleData{m.Id, m.Name, perms}
+}
+
+func (c *permissionCache) get(id appgo.Id) ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.m[id]
+	if !ok {
+		return nil, false
+	}
+	if e.until.Before(time.Now()) {
+		delete(c.m, id)
+		return nil, false
+	}
+	return e.perms, true
+}
+
+func (c *permissionCache) add(id appgo.Id, perms []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.m) >= permissionCacheSize {
+		c.m = make(map[appgo.Id]*cachedPermissions)
+	}
+	c.m[id] = &cachedPermissions{perms, time.Now().Add(c.ttl)}
+}
+
+func (c *permissionCache) remove(id appgo.Id) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.m, id)
+}
+
+func (c *permissionCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.m = make(map[appgo.Id]*cachedPermissions)
+}
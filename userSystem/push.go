@@ -1,14 +1,22 @@
 package userSystem
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/realtime"
 	"strings"
 )
 
 func (u *UserSystem) PushTo(users []appgo.Id, content *appgo.PushData) {
+	u.PushToCtx(context.Background(), users, content)
+}
+
+// PushToCtx is PushTo with the requests of ContextPushers traced as part
+// of ctx
+func (u *UserSystem) PushToCtx(ctx context.Context, users []appgo.Id, content *appgo.PushData) {
 	tokens, err := u.GetPushTokens(users)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -22,7 +30,40 @@ func (u *UserSystem) PushTo(users []appgo.Id, content *appgo.PushData) {
 		if p, ok := u.Pushers[provider]; ok {
 			pusher = p
 		}
-		pusher.PushNotif(info, content)
+		if cp, ok := pusher.(appgo.ContextPusher); ok {
+			cp.PushNotifCtx(ctx, info, content)
+		} else {
+			pusher.PushNotif(info, content)
+		}
+	}
+}
+
+// Deliver sends content over websocket to users that are online, and
+// through the vendor pushers to the others.
+func (u *UserSystem) Deliver(users []appgo.Id, content *appgo.PushData) {
+	u.DeliverCtx(context.Background(), users, content)
+}
+
+// DeliverCtx is Deliver with pushes traced as part of ctx
+func (u *UserSystem) DeliverCtx(ctx context.Context, users []appgo.Id, content *appgo.PushData) {
+	online, err := realtime.Online(users)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"users": users,
+			"error": err,
+		}).Errorln("failed to check online users")
+	}
+	var offline []appgo.Id
+	for _, id := range users {
+		if online[id] {
+			if err := realtime.SendToUser(id, realtime.MessageTypePush, content); err == nil {
+				continue
+			}
+		}
+		offline = append(offline, id)
+	}
+	if len(offline) > 0 {
+		u.PushToCtx(ctx, offline, content)
 	}
 }
 
@@ -0,0 +1,104 @@
+package userSystem
+
+import (
+	"encoding/json"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/redis"
+	"time"
+)
+
+const (
+	refreshNamespace       = "refresh"
+	refreshUsedNamespace   = "refresh:used"
+	refreshFamilyNamespace = "refresh:f"
+	refreshUserNamespace   = "refresh:u"
+)
+
+// refreshStore keeps refresh token infos keyed by token hash, used markers,
+// the token hashes of each family and the families of each user.
+type refreshStore struct {
+	tokens   *redis.Strings
+	used     *redis.Strings
+	families *redis.Hashes
+	users    *redis.Hashes
+}
+
+func newRefreshStore() *refreshStore {
+	lifetime := auth.RefreshLifetime()
+	return &refreshStore{
+		redis.NewStrings(refreshNamespace, lifetime),
+		redis.NewStrings(refreshUsedNamespace, lifetime),
+		redis.NewHashes(refreshFamilyNamespace, lifetime),
+		redis.NewHashes(refreshUserNamespace, lifetime),
+	}
+}
+
+func (u *UserSystem) SaveRefreshToken(hash string, info *auth.RefreshTokenInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := u.refresh.tokens.SetEx(hash, ttlUntil(info.ExpiresAt), string(data)); err != nil {
+		return err
+	}
+	if err := u.refresh.families.Set(info.Family, hash, "1"); err != nil {
+		return err
+	}
+	return u.refresh.users.Set(info.UserId, info.Family, "1")
+}
+
+func (u *UserSystem) UseRefreshToken(hash string) (*auth.RefreshTokenInfo, bool, error) {
+	data, err := u.refresh.tokens.Get(hash)
+	if err == redis.ErrNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var info auth.RefreshTokenInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return nil, false, err
+	}
+	set, err := u.refresh.used.SetNx(hash, ttlUntil(info.ExpiresAt), "1")
+	if err != nil {
+		return nil, false, err
+	}
+	return &info, !set, nil
+}
+
+func (u *UserSystem) RevokeRefreshFamily(id appgo.Id, family string) error {
+	hashes, err := u.refresh.families.GetAll(family)
+	if err != nil {
+		return err
+	}
+	for hash := range hashes {
+		if err := u.refresh.tokens.Del(hash); err != nil {
+			return err
+		}
+	}
+	if err := u.refresh.families.Clear(family); err != nil {
+		return err
+	}
+	return u.refresh.users.Del(id, family)
+}
+
+func (u *UserSystem) revokeUserRefreshTokens(id appgo.Id) error {
+	families, err := u.refresh.users.GetAll(id)
+	if err != nil {
+		return err
+	}
+	for family := range families {
+		if err := u.RevokeRefreshFamily(id, family); err != nil {
+			return err
+		}
+	}
+	return u.refresh.users.Clear(id)
+}
+
+func ttlUntil(t time.Time) int {
+	ttl := int(t.Sub(time.Now()) / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	return ttl
+}
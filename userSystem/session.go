@@ -0,0 +1,266 @@
+package userSystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/redis"
+	"sync"
+	"time"
+)
+
+const (
+	sessionNamespace     = "session"
+	sessionUserNamespace = "session:u"
+	sessionCacheSize     = 100000
+
+	defaultSessionCacheSeconds = 30
+)
+
+type Session struct {
+	Id        string
+	UserId    appgo.Id
+	Role      appgo.Role
+	Device    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// sessionStore keeps one redis string per issued token (keyed by session id,
+// expiring with the token) and a hash per user listing all the sessions.
+type sessionStore struct {
+	tokens *redis.Strings
+	users  *redis.Hashes
+	cache  *sessionCache
+}
+
+type sessionCache struct {
+	m    map[string]time.Time
+	ttl  time.Duration
+	lock sync.Mutex
+}
+
+func newSessionStore() *sessionStore {
+	ttl := appgo.Conf.Session.CacheSeconds
+	if ttl <= 0 {
+		ttl = defaultSessionCacheSeconds
+	}
+	return &sessionStore{
+		redis.NewStrings(sessionNamespace, 0),
+		redis.NewHashes(sessionUserNamespace, 0),
+		&sessionCache{
+			m:   make(map[string]time.Time),
+			ttl: time.Duration(ttl) * time.Second,
+		},
+	}
+}
+
+// Validate implements server.TokenStore, tokens of banned users and tokens
+// without a live session are rejected
+func (u *UserSystem) Validate(token auth.Token) bool {
+	if !u.validateBan(token) {
+		return false
+	}
+	if !appgo.Conf.Session.Enable {
+		return true
+	}
+	sid := sessionId(token)
+	if u.sessions.cache.has(sid) {
+		return true
+	}
+	has, err := u.sessions.tokens.Has(sid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sid":   sid,
+			"error": err,
+		}).Errorln("failed to check session")
+		return false
+	}
+	if has {
+		u.sessions.cache.add(sid)
+	}
+	return has
+}
+
+// AddSession registers a newly issued token, device is informational and
+// can be used to log out all sessions of a kind of device.
+func (u *UserSystem) AddSession(id appgo.Id, role appgo.Role, token auth.Token, device string) error {
+	if !appgo.Conf.Session.Enable || token == "" {
+		return nil
+	}
+	now := time.Now()
+	lifetime := auth.TokenLifetime(role)
+	s := &Session{
+		Id:        sessionId(token),
+		UserId:    id,
+		Role:      role,
+		Device:    device,
+		CreatedAt: now,
+	}
+	// Redis rejects SETEX with 0, sessions of roles without a lifetime
+	// last until logout
+	var err error
+	if lifetime > 0 {
+		s.ExpiresAt = now.Add(time.Duration(lifetime) * time.Second)
+		err = u.sessions.tokens.SetEx(s.Id, lifetime, id.String())
+	} else {
+		err = u.sessions.tokens.Set(s.Id, id.String())
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := u.sessions.users.Set(id, s.Id, string(data)); err != nil {
+		return err
+	}
+	u.pruneSessions(id)
+	return nil
+}
+
+func (u *UserSystem) Sessions(id appgo.Id) ([]*Session, error) {
+	all, err := u.sessions.users.GetAll(id)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Session, 0, len(all))
+	for sid, data := range all {
+		var s Session
+		if err := json.Unmarshal([]byte(data), &s); err != nil {
+			log.WithFields(log.Fields{
+				"sid":   sid,
+				"error": err,
+			}).Errorln("bad session data")
+			continue
+		}
+		ret = append(ret, &s)
+	}
+	return ret, nil
+}
+
+// Logout revokes the session of token
+func (u *UserSystem) Logout(token auth.Token) error {
+	id, _ := token.Validate()
+	if id == 0 {
+		return appgo.UnauthorizedErr
+	}
+	return u.revokeSessions(id, sessionId(token))
+}
+
+// LogoutDevice revokes all sessions of id on the given kind of device
+func (u *UserSystem) LogoutDevice(id appgo.Id, device string) error {
+	sessions, err := u.Sessions(id)
+	if err != nil {
+		return err
+	}
+	var sids []string
+	for _, s := range sessions {
+		if s.Device == device {
+			sids = append(sids, s.Id)
+		}
+	}
+	return u.revokeSessions(id, sids...)
+}
+
+// LogoutAll revokes all sessions and refresh tokens of id, on all devices
+func (u *UserSystem) LogoutAll(id appgo.Id) error {
+	if err := u.revokeUserRefreshTokens(id); err != nil {
+		return err
+	}
+	all, err := u.sessions.users.GetAll(id)
+	if err != nil {
+		return err
+	}
+	sids := make([]string, 0, len(all))
+	for sid := range all {
+		sids = append(sids, sid)
+	}
+	if err := u.revokeSessions(id, sids...); err != nil {
+		return err
+	}
+	return u.sessions.users.Clear(id)
+}
+
+func (u *UserSystem) revokeSessions(id appgo.Id, sids ...string) error {
+	fields := make([]interface{}, 0, len(sids))
+	for _, sid := range sids {
+		if err := u.sessions.tokens.Del(sid); err != nil {
+			return err
+		}
+		u.sessions.cache.remove(sid)
+		fields = append(fields, sid)
+	}
+	return u.sessions.users.Del(id, fields...)
+}
+
+func (u *UserSystem) pruneSessions(id appgo.Id) {
+	sessions, err := u.Sessions(id)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	var expired []interface{}
+	for _, s := range sessions {
+		if !s.ExpiresAt.IsZero() && s.ExpiresAt.Before(now) {
+			expired = append(expired, s.Id)
+		}
+	}
+	if err := u.sessions.users.Del(id, expired...); err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Errorln("failed to prune sessions")
+	}
+}
+
+func sessionDevice(role appgo.Role, platform appgo.Platform) string {
+	switch {
+	case role == appgo.RoleAppUser && platform == appgo.PlatformIos:
+		return "ios"
+	case role == appgo.RoleAppUser && platform == appgo.PlatformAndroid:
+		return "android"
+	case role == appgo.RoleAppUser:
+		return "app"
+	case role == appgo.RoleWebAdmin:
+		return "admin"
+	default:
+		return "web"
+	}
+}
+
+func sessionId(token auth.Token) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *sessionCache) has(sid string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	until, ok := c.m[sid]
+	if ok && until.Before(time.Now()) {
+		delete(c.m, sid)
+		return false
+	}
+	return ok
+}
+
+func (c *sessionCache) add(sid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Dropping everything is cheap and keeps memory bounded
+	if len(c.m) >= sessionCacheSize {
+		c.m = make(map[string]time.Time)
+	}
+	c.m[sid] = time.Now().Add(c.ttl)
+}
+
+func (c *sessionCache) remove(sid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.m, sid)
+}
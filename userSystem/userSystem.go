@@ -2,6 +2,7 @@ package userSystem
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	log "github.com/Sirupsen/logrus"
@@ -9,11 +10,12 @@ import (
 	"github.com/oxfeeefeee/appgo"
 	"github.com/oxfeeefeee/appgo/auth"
 	"github.com/oxfeeefeee/appgo/database"
+	"github.com/oxfeeefeee/appgo/services/apple"
 	"github.com/oxfeeefeee/appgo/services/qiniu"
 	"github.com/oxfeeefeee/appgo/services/qq"
 	"github.com/oxfeeefeee/appgo/services/weibo"
 	"github.com/oxfeeefeee/appgo/services/weixin"
-	"github.com/oxfeeefeee/appgo/toolkit/crypto"
+	"github.com/oxfeeefeee/appgo/trace"
 	"github.com/parnurzeal/gorequest"
 )
 
@@ -21,6 +23,9 @@ var U *UserSystem
 
 type OnCreatedCallback func(id appgo.Id) error
 
+// OnMergedCallback moves app data of user from to user into
+type OnMergedCallback func(from, into appgo.Id) error
+
 type UserDataFromOAuthCode func(code string) (*UserData, string, error)
 
 type UserSystem struct {
@@ -29,7 +34,12 @@ type UserSystem struct {
 	Pushers       map[string]appgo.Pusher
 	DefaultPusher appgo.Pusher
 	OnCreated     OnCreatedCallback
+	OnMerged      OnMergedCallback
 	OAuths        []UserDataFromOAuthCode
+	sessions      *sessionStore
+	refresh       *refreshStore
+	bans          *banStore
+	permissions   *permissionCache
 	appgo.MobileMsgSender
 	appgo.KvStore
 }
@@ -40,6 +50,7 @@ type UserSystemSettings struct {
 	MobileMsgSender appgo.MobileMsgSender
 	KvStore         appgo.KvStore
 	OnCreated       OnCreatedCallback
+	OnMerged        OnMergedCallback
 	OAuths          []UserDataFromOAuthCode
 }
 
@@ -80,21 +91,55 @@ func Init(db *gorm.DB, settings UserSystemSettings) *UserSystem {
 		pushers,
 		&defaultPusher{},
 		settings.OnCreated,
+		settings.OnMerged,
 		settings.OAuths,
+		newSessionStore(),
+		newRefreshStore(),
+		newBanStore(),
+		newPermissionCache(),
 		sender,
 		store,
 	}
 	initTable(db)
-	mobileSupport := U
-	if settings.MobileMsgSender == nil || settings.KvStore == nil {
-		mobileSupport = nil
+	// Login states need to be shared by all instances
+	if len(appgo.Conf.Oidc) > 0 && settings.KvStore == nil {
+		panic("oidc logins need a KvStore")
+	}
+	// The supports are only KvCounters if the KvStore is, auth falls back
+	// to racy counters otherwise
+	var us userSupport = U
+	if _, ok := store.(appgo.KvCounter); ok {
+		us = counterUserSystem{U}
+	}
+	var mobileSupport auth.MobileSupport
+	if settings.MobileMsgSender != nil && settings.KvStore != nil {
+		mobileSupport = us
 	}
-	auth.Init(U, U, U, U, mobileSupport, U)
+	auth.Init(us, us, us, us, mobileSupport, us)
 	return U
 }
 
-func (u *UserSystem) Validate(token auth.Token) bool {
-	return true //todo
+// userSupport is what UserSystem supports of auth
+type userSupport interface {
+	auth.UserSystem
+	auth.WeixinSupport
+	auth.WeiboSupport
+	auth.QqSupport
+	auth.MobileSupport
+	auth.OAuthSupport
+}
+
+// counterUserSystem is an appgo.KvCounter with the counters of the KvStore
+type counterUserSystem struct {
+	*UserSystem
+}
+
+func (u counterUserSystem) Incr(k string, timeout int) (int64, error) {
+	return u.KvStore.(appgo.KvCounter).Incr(k, timeout)
+}
+
+func (u counterUserSystem) Del(k string) error {
+	return u.KvStore.(appgo.KvCounter).Del(k)
 }
 
 func (u *UserSystem) GetUserModel(id appgo.Id) (*UserModel, error) {
@@ -118,7 +163,15 @@ func (u *UserSystem) CheckIn(id appgo.Id, role appgo.Role,
 	if role > user.Role {
 		return false, nil, appgo.ForbiddenErr
 	}
-	// TODO save other tokens
+	if ban, err := u.checkBan(user); err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Errorln("failed to check ban")
+		return false, nil, appgo.InternalErr
+	} else if ban != nil {
+		return true, ban, nil
+	}
 	if newToken != "" && role == appgo.RoleAppUser {
 		tk := sql.NullString{string(newToken), true}
 		if err := u.db.Model(user).Updates(&UserModel{AppToken: tk}).Error; err != nil {
@@ -129,7 +182,14 @@ func (u *UserSystem) CheckIn(id appgo.Id, role appgo.Role,
 			return false, nil, appgo.InternalErr
 		}
 	}
-	// todo stuff about ban
+	device := sessionDevice(role, user.Platform)
+	if err := u.AddSession(id, role, newToken, device); err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Errorln("failed to add session")
+		return false, nil, appgo.InternalErr
+	}
 	return false, user, nil
 }
 
@@ -224,21 +284,38 @@ func (u *UserSystem) AddQqUser(info *qq.UserInfo) (appgo.Id, error) {
 	return u.saveUser(user)
 }
 
+func (u *UserSystem) GetAppleUser(sub string) (appgo.Id, error) {
+	return getUser(u.db, &UserModel{
+		AppleId: database.SqlStr(sub)})
+}
+
+func (u *UserSystem) AddAppleUser(info *apple.UserInfo) (appgo.Id, error) {
+	user := &UserModel{
+		Role:     appgo.RoleAppUser,
+		AppleId:  database.SqlStr(info.Sub),
+		Nickname: database.SqlStr(info.Nickname),
+	}
+	// Emails are unique, users who signed up otherwise keep theirs
+	if info.Email != "" && info.EmailVerified {
+		if uid, err := getUser(u.db, &UserModel{
+			Email: database.SqlStr(info.Email)}); err != nil {
+			return 0, err
+		} else if uid == 0 {
+			user.Email = database.SqlStr(info.Email)
+		}
+	}
+	return u.saveUser(user)
+}
+
 func (u *UserSystem) GetOAuthUser(index int, id string) (appgo.Id, error) {
-	if index < 0 || index > 1 {
+	if index < 0 || index >= len(u.OAuths) {
 		return 0, errors.New("Invalid index")
 	}
-	if index == 0 {
-		return getUser(u.db, &UserModel{
-			OAuth0Id: database.SqlStr(id)})
-	} else {
-		return getUser(u.db, &UserModel{
-			OAuth1Id: database.SqlStr(id)})
-	}
+	return u.GetIdentityUser(auth.OAuthProvider(index), id)
 }
 
 func (u *UserSystem) AddOAuthUser(index int, id string, ui interface{}) (appgo.Id, error) {
-	if index < 0 || index > 1 {
+	if index < 0 || index >= len(u.OAuths) {
 		return 0, errors.New("Invalid index")
 	}
 	userInfo, ok := ui.(*UserData)
@@ -246,20 +323,18 @@ func (u *UserSystem) AddOAuthUser(index int, id string, ui interface{}) (appgo.I
 		return 0, errors.New("Invalid user data")
 	}
 	var user UserModel
-	if index == 0 {
-		user.OAuth0Id = database.SqlStr(id)
-	} else {
-		user.OAuth1Id = database.SqlStr(id)
-	}
 	user.Role = appgo.RoleAppUser
 	user.Nickname = database.SqlStr(*userInfo.Nickname)
 	user.Portrait = database.SqlStr(*userInfo.Portrait)
 	user.Sex = userInfo.Sex
-	return u.saveUser(&user)
+	return u.saveIdentityUser(&user, &IdentityModel{
+		Provider: auth.OAuthProvider(index),
+		Subject:  id,
+	})
 }
 
 func (u *UserSystem) GetOAuthUserInfo(index int, code string) (interface{}, string, error) {
-	if index < 0 || index > 1 || index >= len(u.OAuths) {
+	if index < 0 || index >= len(u.OAuths) {
 		return nil, "", errors.New("Invalid index")
 	}
 	return u.OAuths[index](code)
@@ -286,29 +361,29 @@ func (u *UserSystem) GetMobileUser(mobile, password string) (appgo.Id, error) {
 		}
 		return 0, db.Error
 	}
-	if len(user.PasswordSalt) == 0 || len(user.PasswordHash) == 0 {
+	if !user.Password.Valid &&
+		(len(user.PasswordSalt) == 0 || len(user.PasswordHash) == 0) {
 		return 0, errors.New("password not set yet")
 	}
-	hash := crypto.SaltedHash(user.PasswordSalt, password)
-	if !bytes.Equal(hash[:], user.PasswordHash) {
-		return 0, appgo.InvalidPasswordErr
+	if ok, err := u.checkPassword(&user, password); err != nil {
+		return 0, err
+	} else if !ok {
+		return user.Id, appgo.InvalidPasswordErr
 	}
 	return user.Id, nil
 }
 
 func (u *UserSystem) AddMobileUser(info *auth.MobileUserInfo) (appgo.Id, error) {
-	if salt, err := crypto.RandBytes(64); err != nil {
+	if hash, err := hashPassword(info.Password); err != nil {
 		return 0, err
 	} else {
-		hash := crypto.SaltedHash(salt, info.Password)
 		user := &UserModel{
-			Role:         appgo.RoleAppUser,
-			Mobile:       database.SqlStr(info.Mobile),
-			PasswordSalt: salt,
-			PasswordHash: hash[:],
-			Nickname:     database.SqlStr(info.Nickname),
-			Portrait:     database.SqlStr(info.Portrait),
-			Sex:          info.Sex,
+			Role:     appgo.RoleAppUser,
+			Mobile:   database.SqlStr(info.Mobile),
+			Password: hash,
+			Nickname: database.SqlStr(info.Nickname),
+			Portrait: database.SqlStr(info.Portrait),
+			Sex:      info.Sex,
 		}
 		return u.saveUser(user)
 	}
@@ -316,21 +391,26 @@ func (u *UserSystem) AddMobileUser(info *auth.MobileUserInfo) (appgo.Id, error)
 
 func (u *UserSystem) UpdatePwByMobile(mobile, password string) error {
 	where := &UserModel{Mobile: database.SqlStr(mobile)}
-	if uid, err := getUser(u.db, where); err != nil {
+	uid, err := getUser(u.db, where)
+	if err != nil {
 		return err
 	} else if uid == 0 {
 		return errors.New("UpdatePwByMobile: user not found")
 	}
-	if salt, err := crypto.RandBytes(64); err != nil {
+	if hash, err := hashPassword(password); err != nil {
 		return err
 	} else {
-		hash := crypto.SaltedHash(salt, password)
-		update := &UserModel{PasswordSalt: salt, PasswordHash: hash[:]}
+		update := map[string]interface{}{
+			"password":      hash,
+			"password_salt": nil,
+			"password_hash": nil,
+		}
 		if err := u.db.Model(&UserModel{}).Where(where).
 			Updates(update).Error; err != nil {
 			return err
 		}
-		return nil
+		// Sessions opened with the old password are not trusted any more
+		return u.LogoutAll(uid)
 	}
 }
 
@@ -349,9 +429,12 @@ func (u *UserSystem) SetMobileForUser(mobile string, userId appgo.Id) error {
 }
 
 func (u *UserSystem) UpdateAppToken(id appgo.Id, role appgo.Role) (string, error) {
+	user, err := u.GetUserModel(id)
+	if err != nil {
+		return "", err
+	}
 	newToken := auth.NewToken(id, role)
 	tk := sql.NullString{string(newToken), true}
-	user := &UserModel{Id: id}
 	if err := u.db.Model(user).Updates(&UserModel{AppToken: tk}).Error; err != nil {
 		log.WithFields(log.Fields{
 			"id":        id,
@@ -359,6 +442,14 @@ func (u *UserSystem) UpdateAppToken(id appgo.Id, role appgo.Role) (string, error
 		}).Errorln("failed to save token")
 		return "", appgo.InternalErr
 	}
+	device := sessionDevice(role, user.Platform)
+	if err := u.AddSession(id, role, newToken, device); err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Errorln("failed to add session")
+		return "", appgo.InternalErr
+	}
 	return tk.String, nil
 }
 
@@ -410,7 +501,7 @@ func dataToDbModel(data *UserData) *UserModel {
 }
 
 func copyImage(from, to string) (string, error) {
-	_, body, errs := gorequest.New().Get(from).End()
+	_, body, errs := trace.Do(context.Background(), gorequest.New().Get(from))
 	if errs != nil {
 		errstr := "Failed to get image: " + from
 		log.WithFields(log.Fields{
@@ -453,4 +544,11 @@ func initTable(db *gorm.DB) {
 	} else {
 		db.AutoMigrate(&user)
 	}
+	if err := db.AutoMigrate(&RoleModel{}, &UserRoleModel{},
+		&BanModel{}, &IdentityModel{}).Error; err != nil {
+		log.WithFields(log.Fields{
+			"gormError": err,
+		}).Infoln("failed to migrate tables")
+	}
+	migrateOAuthIds(db)
 }